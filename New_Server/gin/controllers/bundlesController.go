@@ -0,0 +1,276 @@
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// bundleManifestName is the entry listing the files of a bundle
+const bundleManifestName = "manifest.json"
+
+// Manifests larger than this are rejected
+const maxBundleManifestSize = 16 << 20
+
+// errBundleMismatch means the bundle content differs from its manifest. The sender
+// gets a checksum mismatch and uploads the bundle again
+var errBundleMismatch = errors.New("bundle does not match its manifest")
+
+type bundleManifest struct {
+	Files []bundleEntry `json:"files"`
+}
+
+type bundleEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// UploadBundle receives a zip or tar.gz with many small files from the sender,
+// checks every entry against manifest.json and stores the entries where
+// UploadHandler would store them one by one. If any entry does not match,
+// nothing from the bundle is kept
+func UploadBundle(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "File not found",
+		})
+		return
+	}
+	if !strings.HasSuffix(file.Filename, ".zip") && !strings.HasSuffix(file.Filename, ".tar.gz") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Bundle must be a .zip or .tar.gz file",
+		})
+		return
+	}
+
+	// The bundle is kept in a temporary file only while it is unpacked
+	tmp, err := os.CreateTemp("", "bundle-*")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to save file",
+		})
+		return
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	checksum, err := saveWithChecksum(file, tmp.Name())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to save file",
+		})
+		return
+	}
+	if !checksumMatches(c, c.PostForm("sha256"), checksum) {
+		fmt.Printf("Checksum mismatch for bundle %s\n", file.Filename)
+		return
+	}
+
+	stored, err := extractBundle(tmp.Name(), file.Filename)
+	if errors.Is(err, errBundleMismatch) {
+		fmt.Printf("Bundle %s rejected: %v\n", file.Filename, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+			"code":  checksumMismatchCode,
+		})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Bundle %s rejected: %v\n", file.Filename, err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid bundle: " + err.Error(),
+		})
+		return
+	}
+
+	fmt.Printf("Uploaded bundle: %s (%d files)\n", file.Filename, len(stored))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Bundle uploaded successfully!", "files": stored, "sha256": checksum,
+	})
+}
+
+// forEachBundleEntry calls fn for every regular file of a zip or tar.gz
+func forEachBundleEntry(bundlePath, bundleName string, fn func(name string, content io.Reader) error) error {
+	if strings.HasSuffix(bundleName, ".zip") {
+		archive, err := zip.OpenReader(bundlePath)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		for _, entry := range archive.File {
+			if entry.FileInfo().IsDir() {
+				continue
+			}
+			content, err := entry.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(entry.Name, content)
+			_ = content.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(header.Name, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// readBundleManifest finds manifest.json in the bundle and checks the entry names
+func readBundleManifest(bundlePath, bundleName string) (map[string]bundleEntry, error) {
+	var data []byte
+	err := forEachBundleEntry(bundlePath, bundleName, func(name string, content io.Reader) error {
+		if name != bundleManifestName {
+			return nil
+		}
+		var err error
+		data, err = io.ReadAll(io.LimitReader(content, maxBundleManifestSize+1))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%s is missing", bundleManifestName)
+	}
+	if len(data) > maxBundleManifestSize {
+		return nil, fmt.Errorf("%s is too large", bundleManifestName)
+	}
+
+	var manifest bundleManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", bundleManifestName, err)
+	}
+	entries := make(map[string]bundleEntry, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		if _, err := relativeDir(entry.Name); err != nil || path.Base(entry.Name) == "." || entry.Name == bundleManifestName {
+			return nil, fmt.Errorf("invalid file name in %s: %q", bundleManifestName, entry.Name)
+		}
+		if _, ok := entries[entry.Name]; ok {
+			return nil, fmt.Errorf("duplicate file in %s: %q", bundleManifestName, entry.Name)
+		}
+		entries[entry.Name] = entry
+	}
+	return entries, nil
+}
+
+// extractBundle stores the bundle entries and returns their paths. Stored files
+// are removed again if the bundle turns out to be invalid
+func extractBundle(bundlePath, bundleName string) ([]gin.H, error) {
+	entries, err := readBundleManifest(bundlePath, bundleName)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored []gin.H
+	seen := make(map[string]bool, len(entries))
+	err = forEachBundleEntry(bundlePath, bundleName, func(name string, content io.Reader) error {
+		if name == bundleManifestName {
+			return nil
+		}
+		entry, ok := entries[name]
+		if !ok || seen[name] {
+			return fmt.Errorf("%w: unexpected entry %q", errBundleMismatch, name)
+		}
+		seen[name] = true
+
+		savedPath, err := saveBundleEntry(entry, content)
+		if savedPath != "" {
+			stored = append(stored, gin.H{"name": name, "path": savedPath, "sha256": entry.SHA256})
+		}
+		return err
+	})
+	if err == nil && len(seen) != len(entries) {
+		err = fmt.Errorf("%w: %d of %d files are missing", errBundleMismatch, len(entries)-len(seen), len(entries))
+	}
+	if err != nil {
+		for _, file := range stored {
+			_ = os.Remove(file["path"].(string))
+		}
+		return nil, err
+	}
+	return stored, nil
+}
+
+// saveBundleEntry stores one entry where UploadHandler would store the file and
+// checks its size and SHA-256. The saved path is returned even on mismatch, so
+// the caller can remove it
+func saveBundleEntry(entry bundleEntry, content io.Reader) (string, error) {
+	base := path.Base(entry.Name)
+	relDir, err := relativeDir(entry.Name)
+	if err != nil {
+		return "", err
+	}
+	saveDir, err := makeSaveDir(saveDirFor(base), relDir)
+	if err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(base)
+	newFilename, err := getUniqueFilename(saveDir, strings.TrimSuffix(base, ext), ext)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := os.Create(newFilename)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.New()
+	// One byte more than declared shows that the entry is larger than in the manifest
+	n, err := io.CopyN(io.MultiWriter(out, digest), content, entry.Size+1)
+	if err == io.EOF {
+		err = nil
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return newFilename, err
+	}
+	if n != entry.Size {
+		return newFilename, fmt.Errorf("%w: %s has %d bytes instead of %d", errBundleMismatch, entry.Name, n, entry.Size)
+	}
+	if actual := hex.EncodeToString(digest.Sum(nil)); !strings.EqualFold(actual, entry.SHA256) {
+		return newFilename, fmt.Errorf("%w: SHA-256 of %s is %s instead of %s", errBundleMismatch, entry.Name, actual, entry.SHA256)
+	}
+	return newFilename, nil
+}
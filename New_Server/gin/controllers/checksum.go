@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Error code returned when the received file does not match the sender's SHA-256.
+// The sender treats it as a transfer error and retries the upload
+const checksumMismatchCode = "checksum_mismatch"
+
+// saveWithChecksum saves an uploaded file and returns its hex SHA-256
+func saveWithChecksum(file *multipart.FileHeader, dst string) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, digest), src)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// fileChecksum returns the hex SHA-256 of a file on disk
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// checksumMatches compares the checksum sent by the client with the actual one and
+// responds with 422 on mismatch. Clients that send no checksum are not checked
+func checksumMatches(c *gin.Context, expected, actual string) bool {
+	if expected == "" || strings.EqualFold(expected, actual) {
+		return true
+	}
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error":    "Checksum mismatch",
+		"code":     checksumMismatchCode,
+		"expected": expected,
+		"actual":   actual,
+	})
+	return false
+}
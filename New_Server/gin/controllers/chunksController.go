@@ -0,0 +1,291 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Directory for chunked uploads that are not complete yet
+const partialDir = "partial"
+
+var uploadIDPattern = regexp.MustCompile(`^[a-f0-9]{16,64}$`)
+
+// Serialize requests for the same upload id
+var chunkLocks sync.Map
+
+type chunkMeta struct {
+	Filename string `json:"filename"`
+	Length   int64  `json:"length"`
+	Dir      string `json:"dir,omitempty"`
+}
+
+func lockUpload(id string) func() {
+	value, _ := chunkLocks.LoadOrStore(id, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+func partialPaths(id string) (string, string) {
+	return filepath.Join(partialDir, id+".part"), filepath.Join(partialDir, id+".json")
+}
+
+func uploadIDParam(c *gin.Context) (string, bool) {
+	id := c.Param("id")
+	if !uploadIDPattern.MatchString(id) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid upload id",
+		})
+		return "", false
+	}
+	return id, true
+}
+
+func partialSize(partPath string) (int64, error) {
+	info, err := os.Stat(partPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// ChunkStatus returns how many bytes of the upload are already stored
+func ChunkStatus(c *gin.Context) {
+	id, ok := uploadIDParam(c)
+	if !ok {
+		return
+	}
+
+	unlock := lockUpload(id)
+	defer unlock()
+
+	partPath, metaPath := partialPaths(id)
+	if _, err := os.Stat(metaPath); os.IsNotExist(err) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Upload not found",
+		})
+		return
+	}
+
+	offset, err := partialSize(partPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to read upload",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"offset": offset,
+	})
+}
+
+// UploadChunk appends the request body to the partial file at Upload-Offset
+func UploadChunk(c *gin.Context) {
+	id, ok := uploadIDParam(c)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid Upload-Offset",
+		})
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid Upload-Length",
+		})
+		return
+	}
+	name, err := url.PathUnescape(c.GetHeader("Upload-Name"))
+	name = filepath.Base(name)
+	if err != nil || name == "." || name == string(filepath.Separator) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid Upload-Name",
+		})
+		return
+	}
+	relPath, err := url.PathUnescape(c.GetHeader("Upload-Path"))
+	var relDir string
+	if err == nil {
+		relDir, err = relativeDir(relPath)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid Upload-Path",
+		})
+		return
+	}
+
+	unlock := lockUpload(id)
+	defer unlock()
+
+	partPath, metaPath := partialPaths(id)
+
+	// Remember file name and size on the first chunk
+	meta, err := readChunkMeta(metaPath)
+	if os.IsNotExist(err) {
+		meta = chunkMeta{Filename: name, Length: length, Dir: relDir}
+		err = writeChunkMeta(metaPath, meta)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to save upload state",
+		})
+		return
+	}
+	if meta.Length != length {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Upload-Length does not match the upload",
+		})
+		return
+	}
+
+	current, err := partialSize(partPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to read upload",
+		})
+		return
+	}
+	if current != offset {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "Offset mismatch",
+			"offset": current,
+		})
+		return
+	}
+
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to save chunk",
+		})
+		return
+	}
+	defer file.Close()
+
+	// Never write past the declared file size
+	written, err := io.Copy(file, io.LimitReader(c.Request.Body, length-offset))
+	if err != nil {
+		// Keep what was written, the client resumes from the stored offset
+		fmt.Printf("Chunk of %s interrupted after %d bytes: %s\n", id, written, err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":  "Unable to save chunk",
+			"offset": offset + written,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"offset": offset + written,
+	})
+}
+
+// CompleteChunkedUpload moves the assembled file to its upload directory
+func CompleteChunkedUpload(c *gin.Context) {
+	id, ok := uploadIDParam(c)
+	if !ok {
+		return
+	}
+
+	unlock := lockUpload(id)
+	defer unlock()
+
+	partPath, metaPath := partialPaths(id)
+	meta, err := readChunkMeta(metaPath)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Upload not found",
+		})
+		return
+	}
+
+	current, err := partialSize(partPath)
+	if err != nil || current != meta.Length {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "Upload is incomplete",
+			"offset": current,
+		})
+		return
+	}
+
+	ext := filepath.Ext(meta.Filename)
+	saveDir, err := makeSaveDir(saveDirFor(meta.Filename), meta.Dir)
+	var newFilename string
+	if err == nil {
+		newFilename, err = getUniqueFilename(saveDir, strings.TrimSuffix(meta.Filename, ext), ext)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to save file",
+		})
+		return
+	}
+
+	// A corrupted upload is discarded so that the sender starts it over
+	checksum, err := fileChecksum(partPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to save file",
+		})
+		return
+	}
+	if !checksumMatches(c, c.GetHeader("Upload-SHA256"), checksum) {
+		fmt.Printf("Checksum mismatch for %s, upload discarded\n", meta.Filename)
+		_ = os.Remove(partPath)
+		_ = os.Remove(metaPath)
+		return
+	}
+
+	if err := os.Rename(partPath, newFilename); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to save file",
+		})
+		return
+	}
+	_ = os.Remove(metaPath)
+	chunkLocks.Delete(id)
+
+	fmt.Printf("Assembled file: %s\n", meta.Filename)
+	fmt.Printf("File size: %d\n", meta.Length)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "File uploaded successfully!", "path": newFilename, "offset": meta.Length, "sha256": checksum,
+	})
+}
+
+func readChunkMeta(metaPath string) (chunkMeta, error) {
+	var meta chunkMeta
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+func writeChunkMeta(metaPath string, meta chunkMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, data, 0644)
+}
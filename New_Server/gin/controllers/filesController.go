@@ -20,13 +20,23 @@ func UploadHandler(c *gin.Context) {
 
 	}
 
+	// Relative path of the file in the sender's directory tree (optional)
+	relDir, err := relativeDir(c.PostForm("path"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid path",
+		})
+		return
+	}
+
 	// Case of dir to upload
-	var saveDir string
 	ext := filepath.Ext(file.Filename)
-	if ext == ".txt" || ext == ".q" {
-		saveDir = "uploads"
-	} else {
-		saveDir = "unknown"
+	saveDir, err := makeSaveDir(saveDirFor(file.Filename), relDir)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Unable to save file",
+		})
+		return
 	}
 
 	// Get Filename without extension
@@ -44,9 +54,9 @@ func UploadHandler(c *gin.Context) {
 	fmt.Printf("File size: %d\n", file.Size)
 	fmt.Printf("File type: %s\n", file.Header)
 
-	// Save the file to a specific location on the server
-
-	if err := c.SaveUploadedFile(file, newFilename); err != nil {
+	// Save the file to a specific location on the server, hashing it on the way
+	checksum, err := saveWithChecksum(file, newFilename)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Unable to save file",
 		})
@@ -54,12 +64,66 @@ func UploadHandler(c *gin.Context) {
 		return
 	}
 
+	// The sender's SHA-256 follows the file in the form
+	if !checksumMatches(c, c.PostForm("sha256"), checksum) {
+		fmt.Printf("Checksum mismatch for %s, file removed\n", file.Filename)
+		_ = os.Remove(newFilename)
+		return
+	}
+
 	// Return a success message
 	c.JSON(http.StatusOK, gin.H{
-		"message": "File uploaded successfully!", "path": newFilename,
+		"message": "File uploaded successfully!", "path": newFilename, "sha256": checksum,
 	})
 }
 
+// saveDirFor chooses the upload directory by file extension. Files encrypted
+// by the sender (name.txt.age) go where the plain file would
+func saveDirFor(filename string) string {
+	ext := filepath.Ext(strings.TrimSuffix(filename, ".age"))
+	if ext == ".txt" || ext == ".q" {
+		return "uploads"
+	}
+	return "unknown"
+}
+
+// relativeDir returns the directory part of a slash-separated relative path
+// sent by the client. Absolute paths and paths leaving the upload dir are rejected
+func relativeDir(relPath string) (string, error) {
+	if relPath == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(relPath, "/") || strings.Contains(relPath, "\\") {
+		return "", fmt.Errorf("path must be relative: %s", relPath)
+	}
+	for _, part := range strings.Split(relPath, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("path must not contain '..': %s", relPath)
+		}
+	}
+
+	dir := filepath.Dir(filepath.FromSlash(relPath))
+	if dir == "." {
+		return "", nil
+	}
+	if filepath.IsAbs(dir) || filepath.VolumeName(dir) != "" || !filepath.IsLocal(dir) {
+		return "", fmt.Errorf("invalid path: %s", relPath)
+	}
+	return dir, nil
+}
+
+// makeSaveDir creates the subdirectory of the upload dir for a relative path
+func makeSaveDir(saveDir, relDir string) (string, error) {
+	if relDir == "" {
+		return saveDir, nil
+	}
+	dir := filepath.Join(saveDir, relDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
 func getUniqueFilename(saveDir, filename, ext string) (string, error) {
 	newFilename := filepath.Join(saveDir, filename+ext)
 	i := 1
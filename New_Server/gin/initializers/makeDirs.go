@@ -6,7 +6,7 @@ import (
 )
 
 func InitDirs() {
-	dirs := []string{"uploads", "unknown"}
+	dirs := []string{"uploads", "unknown", "partial"}
 
 	// Make dir if not exist
 	for _, dir := range dirs {
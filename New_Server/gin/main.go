@@ -6,6 +6,8 @@ import (
 	"gin/middleware"
 	"github.com/gin-gonic/gin"
 	"log"
+	"os"
+	"strings"
 	//"gorm.io/driver/sqlite"
 )
 
@@ -22,10 +24,28 @@ func main() {
 	r.POST("/signup", controllers.SignUp)
 	r.POST("/login", controllers.Login)
 	r.GET("/validate", middleware.RequireAuth, controllers.Validate)
-	r.POST("/upload", middleware.RequireAuth, controllers.UploadHandler)
+
+	// Chunk and bundle routes are relative to the upload route, as the sender
+	// builds them from [Server] Context
+	upload := r.Group(uploadPath(), middleware.RequireAuth)
+	upload.POST("", middleware.DecodeBody, controllers.UploadHandler)
+	upload.POST("/bundle", middleware.DecodeBody, controllers.UploadBundle)
+	upload.GET("/chunk/:id", controllers.ChunkStatus)
+	upload.POST("/chunk/:id", middleware.DecodeBody, controllers.UploadChunk)
+	upload.POST("/chunk/:id/complete", controllers.CompleteChunkedUpload)
 
 	err := r.Run()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
+
+// uploadPath returns UPLOAD_PATH from .env, "/upload" by default. It must match
+// [Server] Context in the sender's config.ini
+func uploadPath() string {
+	path := os.Getenv("UPLOAD_PATH")
+	if path == "" {
+		return "/upload"
+	}
+	return "/" + strings.Trim(path, "/")
+}
@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DecodeBody transparently decompresses request bodies sent with
+// Content-Encoding gzip or zstd, so handlers always read the original bytes
+func DecodeBody(c *gin.Context) {
+	var body io.ReadCloser
+
+	switch strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding"))) {
+	case "", "identity":
+		c.Next()
+		return
+	case "gzip":
+		reader, err := gzip.NewReader(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid gzip body",
+			})
+			return
+		}
+		body = reader
+	case "zstd":
+		decoder, err := zstd.NewReader(c.Request.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid zstd body",
+			})
+			return
+		}
+		body = decoder.IOReadCloser()
+	default:
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": "Unsupported Content-Encoding",
+		})
+		return
+	}
+	defer body.Close()
+
+	// The decoded size is unknown until the body is read
+	c.Request.Body = body
+	c.Request.ContentLength = -1
+	c.Request.Header.Del("Content-Encoding")
+	c.Next()
+}
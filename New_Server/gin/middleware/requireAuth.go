@@ -8,17 +8,22 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
 func RequireAuth(c *gin.Context) {
 	fmt.Println("In middleware")
 
-	//get the cookie off request
+	//get the cookie off request, or a bearer token for non-browser clients
 	tokenString, err := c.Cookie("Authorization")
 	if err != nil {
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		tokenString = strings.TrimPrefix(header, "Bearer ")
 	}
 
 	// Decode and validate it
@@ -27,12 +32,17 @@ func RequireAuth(c *gin.Context) {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return os.Getenv("SECRET"), nil
+		return []byte(os.Getenv("SECRET")), nil
 	})
+	if err != nil || !token.Valid {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok {
 		// Check expire date
-		if float64(time.Now().Unix()) > claims["exp"].(float64) {
+		exp, ok := claims["exp"].(float64)
+		if !ok || float64(time.Now().Unix()) > exp {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
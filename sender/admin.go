@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// adminFile - файл в ответе GET /files
+type adminFile struct {
+	Path        string     `json:"path"`
+	FirstSeen   *time.Time `json:"first_seen,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// adminRoute - состояние направления в ответе GET /files
+type adminRoute struct {
+	Name         string      `json:"name"`
+	Paused       bool        `json:"paused"`
+	ScheduleOpen bool        `json:"schedule_open"`
+	Pending      []adminFile `json:"pending"`
+	InFlight     []adminFile `json:"in_flight"`
+	Failed       []adminFile `json:"failed"`
+}
+
+// checkAdminListen - API управления не защищено паролем, поэтому доступно
+// только с локальной машины
+func checkAdminListen(listen string) error {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("[Admin] Listen: %v", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("[Admin] Listen: %s is not a loopback address", listen)
+	}
+	return nil
+}
+
+// startAdminServer запускает API управления очередью, если задан [Admin] Listen
+func startAdminServer(listen string) {
+	if listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /files", adminFiles)
+	mux.HandleFunc("POST /pause", adminPause(true))
+	mux.HandleFunc("POST /resume", adminPause(false))
+	mux.HandleFunc("POST /retry", adminRetry)
+	mux.HandleFunc("POST /skip", adminSkip)
+	mux.HandleFunc("POST /scan", adminScan)
+	mux.HandleFunc("POST /push", adminPush)
+	mux.HandleFunc("GET /limits", adminLimits)
+	mux.HandleFunc("POST /limits", adminSetLimits)
+
+	go func() {
+		log.Info().Msg(fmt.Sprintf("Admin API listening on http://%s", listen))
+		server := &http.Server{Addr: listen, Handler: loopbackOnly(mux), ReadHeaderTimeout: 10 * time.Second}
+		if err := server.ListenAndServe(); err != nil {
+			log.Error().Msg(fmt.Sprintf("error serving admin API: %v", err))
+		}
+	}()
+}
+
+// loopbackOnly пропускает только локальные запросы. Запросы из браузера
+// (заголовок Origin) и с чужим Host отклоняются, чтобы открытая на этой машине
+// страница не могла управлять очередью, в том числе через DNS rebinding
+func loopbackOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin API is only available locally"})
+			return
+		}
+		if req.Header.Get("Origin") != "" || !isLoopbackHost(req.Host) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin API does not accept browser or non-local Host requests"})
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func isLoopbackHost(hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	host = strings.Trim(host, "[]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(value)
+}
+
+// selectRoutes возвращает направление из параметра route или все направления
+func selectRoutes(req *http.Request) ([]*route, error) {
+	name := req.URL.Query().Get("route")
+	if name == "" {
+		return routes, nil
+	}
+	for _, r := range routes {
+		if r.name == name {
+			return []*route{r}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown route %q", name)
+}
+
+// selectRoute - для действий с файлом направление можно не указывать, если оно одно
+func selectRoute(req *http.Request) (*route, error) {
+	selected, err := selectRoutes(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) != 1 {
+		return nil, errors.New("route parameter is required when several routes are configured")
+	}
+	return selected[0], nil
+}
+
+// fileParam проверяет параметр file - путь относительно каталога направления
+func fileParam(req *http.Request) (string, error) {
+	file := filepath.FromSlash(req.URL.Query().Get("file"))
+	if file == "" || !filepath.IsLocal(file) {
+		return "", errors.New("file parameter must be a path relative to the route directory")
+	}
+	return file, nil
+}
+
+// GET /files - файлы в очереди, в работе и в каталоге неотправленных
+func adminFiles(w http.ResponseWriter, req *http.Request) {
+	selected, err := selectRoutes(req)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+
+	result := make([]adminRoute, 0, len(selected))
+	for _, r := range selected {
+		result = append(result, r.adminState())
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"routes": result})
+}
+
+func (r *route) adminState() adminRoute {
+	state := adminRoute{
+		Name:         r.name,
+		Paused:       r.paused.Load(),
+		ScheduleOpen: r.config().schedule.open(time.Now()),
+		Pending:      []adminFile{},
+		InFlight:     []adminFile{},
+	}
+
+	queued := r.waitingFiles()
+	r.mu.Lock()
+	for filePath, firstSeen := range r.firstSeen {
+		firstSeen := firstSeen
+		file := adminFile{Path: filepath.ToSlash(r.relativePath(filePath)), FirstSeen: &firstSeen}
+		if retry, ok := r.retries[filePath]; ok {
+			nextAttempt := retry.nextAttempt
+			file.Attempts, file.NextAttempt, file.LastError = retry.attempts, &nextAttempt, retry.lastError
+		}
+		if r.inFlight[filePath] && !queued[filePath] {
+			state.InFlight = append(state.InFlight, file)
+		} else {
+			state.Pending = append(state.Pending, file)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Slice(state.Pending, func(i, j int) bool { return state.Pending[i].Path < state.Pending[j].Path })
+	sort.Slice(state.InFlight, func(i, j int) bool { return state.InFlight[i].Path < state.InFlight[j].Path })
+	state.Failed = r.failedFiles()
+	return state
+}
+
+// failedFiles читает каталог неотправленных файлов вместе с описаниями ошибок
+func (r *route) failedFiles() []adminFile {
+	failedDir := r.config().failedDir
+	files := []adminFile{}
+
+	_ = filepath.WalkDir(failedDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasSuffix(path, ".error.json") {
+			return nil
+		}
+		rel, err := filepath.Rel(failedDir, path)
+		if err != nil {
+			return nil
+		}
+		file := adminFile{Path: filepath.ToSlash(rel)}
+
+		if data, err := os.ReadFile(path + ".error.json"); err == nil {
+			var report failureReport
+			if json.Unmarshal(data, &report) == nil {
+				file.Attempts, file.LastError = report.Attempts, report.Error
+			}
+		}
+		files = append(files, file)
+		return nil
+	})
+	return files
+}
+
+// POST /pause и POST /resume - файлы, которые уже отправляются, не прерываются
+func adminPause(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		selected, err := selectRoutes(req)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return
+		}
+
+		for _, r := range selected {
+			r.paused.Store(paused)
+			if paused {
+				// Файлы из очереди вернутся в нее после возобновления
+				r.releaseQueued(false)
+				log.Info().Msg(fmt.Sprintf("Route %s: sending paused via admin API", r.name))
+			} else {
+				log.Info().Msg(fmt.Sprintf("Route %s: sending resumed via admin API", r.name))
+				go scanDir(r)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"paused": paused, "routes": len(selected)})
+	}
+}
+
+// POST /retry?file=... - файл из каталога неотправленных возвращается в каталог
+// отправки, а у файла, ожидающего повторной попытки, ожидание отменяется
+func adminRetry(w http.ResponseWriter, req *http.Request) {
+	r, err := selectRoute(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	file, err := fileParam(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	cfg := r.config()
+
+	// Файл ждет повторной попытки в каталоге отправки
+	sendPath := filepath.Join(cfg.sendDir, file)
+	r.mu.Lock()
+	retry, waiting := r.retries[sendPath]
+	if waiting {
+		retry.nextAttempt = time.Now()
+	}
+	r.mu.Unlock()
+	if waiting {
+		log.Info().Msg(fmt.Sprintf("Retry of %s requested via admin API", sendPath))
+		go checkPath(r, sendPath)
+		writeJSON(w, http.StatusOK, map[string]string{"path": filepath.ToSlash(file), "status": "retrying"})
+		return
+	}
+
+	failedPath := filepath.Join(cfg.failedDir, file)
+	if _, err := os.Stat(failedPath); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "file not found in the failed directory"})
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(sendPath), 0755); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	destPath := uniqueDestPath(filepath.Dir(sendPath), filepath.Base(sendPath))
+	if err := os.Rename(failedPath, destPath); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	_ = os.Remove(failedPath + ".error.json")
+
+	log.Info().Msg(fmt.Sprintf("The file %s was returned for sending via admin API: %s", failedPath, destPath))
+	go checkPath(r, destPath)
+	writeJSON(w, http.StatusOK, map[string]string{"path": filepath.ToSlash(r.relativePath(destPath)), "status": "queued"})
+}
+
+// errSkipped - файл перенесен в каталог неотправленных по команде оператора
+var errSkipped = &sendError{Err: errors.New("skipped via admin API"), Retryable: false}
+
+// POST /skip?file=... - файл из очереди переносится в каталог неотправленных
+func adminSkip(w http.ResponseWriter, req *http.Request) {
+	r, err := selectRoute(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	file, err := fileParam(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	filePath := filepath.Join(r.config().sendDir, file)
+	if _, err := os.Stat(filePath); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "file not found in the send directory"})
+		return
+	}
+	// Закрепляем файл, чтобы его не взял обработчик. Файл, ожидающий в очереди
+	// или в пакете, уже закреплен - он убирается оттуда
+	if !r.claimFile(filePath) && !r.unqueue(filePath) {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "file is being sent"})
+		return
+	}
+
+	r.mu.Lock()
+	attempts := 0
+	if retry, ok := r.retries[filePath]; ok {
+		attempts = retry.attempts
+	}
+	r.mu.Unlock()
+
+	if err := moveToFailed(r, filePath, errSkipped, attempts); err != nil {
+		r.releaseFile(filePath)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("The file %s was skipped via admin API", filePath))
+	go checkPath(r, filePath)
+	writeJSON(w, http.StatusOK, map[string]string{"path": filepath.ToSlash(file), "status": "skipped"})
+}
+
+// POST /push?file=... - файл отправляется сразу, вне окна отправки и без ожидания
+// повторной попытки. Действует на одну следующую попытку
+func adminPush(w http.ResponseWriter, req *http.Request) {
+	r, err := selectRoute(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	file, err := fileParam(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	filePath := filepath.Join(r.config().sendDir, file)
+	if _, err := os.Stat(filePath); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "file not found in the send directory"})
+		return
+	}
+
+	r.mu.Lock()
+	r.pushed[filePath] = true
+	if retry, ok := r.retries[filePath]; ok {
+		retry.nextAttempt = time.Now()
+	}
+	r.mu.Unlock()
+
+	log.Info().Msg(fmt.Sprintf("The file %s was pushed for sending via admin API", filePath))
+	go checkPath(r, filePath)
+	writeJSON(w, http.StatusAccepted, map[string]string{"path": filepath.ToSlash(file), "status": "pushed"})
+}
+
+// POST /scan - внеочередная проверка каталогов отправки
+func adminScan(w http.ResponseWriter, req *http.Request) {
+	selected, err := selectRoutes(req)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	for _, r := range selected {
+		go scanDir(r)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"scanning": len(selected)})
+}
+
+// adminRouteLimits - ограничения направления в ответе /limits
+type adminRouteLimits struct {
+	Name          string `json:"name"`
+	Bandwidth     int64  `json:"bandwidth"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	Active        int    `json:"active"`
+}
+
+// GET /limits - текущие ограничения скорости (байт в секунду) и числа запросов, 0 - без ограничения
+func adminLimits(w http.ResponseWriter, req *http.Request) {
+	selected, err := selectRoutes(req)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, currentLimits(selected))
+}
+
+func currentLimits(selected []*route) map[string]interface{} {
+	result := make([]adminRouteLimits, 0, len(selected))
+	for _, r := range selected {
+		limit, active := r.concurrency.get()
+		result = append(result, adminRouteLimits{Name: r.name, Bandwidth: bandwidthValue(r.bandwidth), MaxConcurrent: limit, Active: active})
+	}
+	return map[string]interface{}{"total_bandwidth": bandwidthValue(totalBandwidth), "routes": result}
+}
+
+// POST /limits?total_bandwidth=...&bandwidth=...&max_concurrent=... - ограничения меняются
+// до перезапуска или перечитывания конфигурации. bandwidth и max_concurrent применяются
+// к направлению route или ко всем направлениям
+func adminSetLimits(w http.ResponseWriter, req *http.Request) {
+	selected, err := selectRoutes(req)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+
+	query := req.URL.Query()
+	var total, bandwidth int64 = -1, -1
+	maxConcurrent := -1
+	if value := query.Get("total_bandwidth"); value != "" {
+		if total, err = parseSize(value); err != nil || total < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "total_bandwidth must be a size, e.g. 512KB"})
+			return
+		}
+	}
+	if value := query.Get("bandwidth"); value != "" {
+		if bandwidth, err = parseSize(value); err != nil || bandwidth < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "bandwidth must be a size, e.g. 512KB"})
+			return
+		}
+	}
+	if value := query.Get("max_concurrent"); value != "" {
+		if maxConcurrent, err = strconv.Atoi(value); err != nil || maxConcurrent < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "max_concurrent must be a non-negative number"})
+			return
+		}
+	}
+
+	if total >= 0 {
+		totalBandwidth.SetLimit(bandwidthLimit(total))
+		log.Info().Msg(fmt.Sprintf("Total bandwidth limit set to %d B/s via admin API", total))
+	}
+	for _, r := range selected {
+		if bandwidth >= 0 {
+			r.bandwidth.SetLimit(bandwidthLimit(bandwidth))
+			log.Info().Msg(fmt.Sprintf("Route %s: bandwidth limit set to %d B/s via admin API", r.name, bandwidth))
+		}
+		if maxConcurrent >= 0 {
+			r.concurrency.set(maxConcurrent)
+			log.Info().Msg(fmt.Sprintf("Route %s: concurrent requests limit set to %d via admin API", r.name, maxConcurrent))
+		}
+	}
+	writeJSON(w, http.StatusOK, currentLimits(selected))
+}
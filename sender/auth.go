@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Способы авторизации на сервере
+const (
+	authBasic    = "basic"     // логин и пароль в заголовке Authorization
+	authJWTLogin = "jwt-login" // токен, полученный через POST /login, в cookie Authorization
+	authBearer   = "bearer"    // заранее выданный токен в заголовке Authorization
+	authNone     = "none"
+)
+
+// Токен обновляется заранее, чтобы не отправлять запросы с истекающим токеном
+const tokenRefreshMargin = 30 * time.Second
+
+// authenticator добавляет к запросам данные авторизации направления
+type authenticator struct {
+	mode     string
+	username string
+	password string
+	token    string // для режима bearer
+	loginURL string // для режима jwt-login
+
+	mu      sync.Mutex
+	jwt     string
+	expires time.Time
+}
+
+// apply добавляет авторизацию к запросу, при необходимости выполняя вход на сервер
+func (a *authenticator) apply(client *http.Client, req *http.Request) error {
+	switch a.mode {
+	case authBasic:
+		req.SetBasicAuth(a.username, a.password)
+	case authBearer:
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	case authJWTLogin:
+		token, err := a.currentToken(client)
+		if err != nil {
+			return err
+		}
+		req.AddCookie(&http.Cookie{Name: "Authorization", Value: token})
+	}
+	return nil
+}
+
+// currentToken возвращает кэшированный токен или получает новый
+func (a *authenticator) currentToken(client *http.Client) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.jwt != "" && (a.expires.IsZero() || time.Now().Add(tokenRefreshMargin).Before(a.expires)) {
+		return a.jwt, nil
+	}
+
+	token, expires, err := a.login(client)
+	if err != nil {
+		return "", err
+	}
+	a.jwt, a.expires = token, expires
+	log.Info().Msg(fmt.Sprintf("Logged in to %s", a.loginURL))
+	return token, nil
+}
+
+// invalidate сбрасывает токен, отклоненный сервером. Если другой обработчик уже
+// получил новый токен, он сохраняется
+func (a *authenticator) invalidate(req *http.Request) bool {
+	if a.mode != authJWTLogin {
+		return false
+	}
+	cookie, err := req.Cookie("Authorization")
+	if err != nil {
+		return false
+	}
+
+	a.mu.Lock()
+	if a.jwt == cookie.Value {
+		a.jwt = ""
+	}
+	a.mu.Unlock()
+	return true
+}
+
+// login получает токен через POST /login с учетными данными из [Auth]
+func (a *authenticator) login(client *http.Client) (string, time.Time, error) {
+	payload, err := json.Marshal(map[string]string{"email": a.username, "password": a.password})
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error creating the login request: %v", err)
+	}
+
+	resp, err := client.Post(a.loginURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return "", time.Time{}, newNetworkError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, newNetworkError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Error().Msg(fmt.Sprintf("error logging in to %s: %s - %s", a.loginURL, resp.Status, body))
+		// Ошибка входа не связана с конкретным файлом, поэтому отправка повторяется.
+		// Сервер отвечает на неверный пароль кодом 400, поэтому любой отказ считается ошибкой авторизации
+		return "", time.Time{}, &sendError{StatusCode: resp.StatusCode, Response: string(body), Retryable: true, Auth: true}
+	}
+
+	// Сервер возвращает токен в cookie, но может передать его и в теле ответа
+	var token string
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "Authorization" {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		var response struct {
+			Token string `json:"token"`
+		}
+		if json.Unmarshal(body, &response) == nil {
+			token = response.Token
+		}
+	}
+	if token == "" {
+		return "", time.Time{}, &sendError{StatusCode: resp.StatusCode, Err: errors.New("login response contains no token"), Retryable: true}
+	}
+
+	return token, tokenExpiry(token), nil
+}
+
+// tokenExpiry читает срок действия из поля exp токена без проверки подписи -
+// подпись проверяет сервер. Если срок неизвестен, токен используется до ответа 401
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err == nil {
+			var claims struct {
+				Exp int64 `json:"exp"`
+			}
+			if json.Unmarshal(payload, &claims) == nil && claims.Exp > 0 {
+				return time.Unix(claims.Exp, 0)
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// do выполняет запрос с авторизацией направления. newRequest вызывается повторно,
+// если сервер отклонил токен: после повторного входа запрос отправляется еще раз
+func (r *route) do(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	cfg := r.config()
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, fmt.Errorf("error creating the request: %v", err)
+		}
+		req = req.WithContext(uploadCtx)
+		if err := cfg.auth.apply(cfg.client, req); err != nil {
+			if req.Body != nil {
+				_ = req.Body.Close()
+			}
+			return nil, err
+		}
+
+		// Запрос ждет свободного места среди одновременных запросов направления
+		if err := r.concurrency.acquire(uploadCtx); err != nil {
+			if req.Body != nil {
+				_ = req.Body.Close()
+			}
+			return nil, err
+		}
+		req.Body = r.throttle(uploadCtx, req.Body)
+		resp, err := cfg.client.Do(req)
+		r.concurrency.release()
+		if err != nil {
+			return nil, newNetworkError(err)
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 1 && cfg.auth.invalidate(req) {
+			resp.Body.Close()
+			log.Info().Msg(fmt.Sprintf("Server rejected the token for %s, logging in again", req.URL))
+			continue
+		}
+		return resp, nil
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Сервер gin отвечает на неверный пароль кодом 400
+func newRejectingLoginServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"Invalid email or password"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLoginRejectedIsAuthFailure(t *testing.T) {
+	server := newRejectingLoginServer(t)
+	a := &authenticator{mode: authJWTLogin, username: "user", password: "wrong", loginURL: server.URL + "/login"}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/upload", nil)
+
+	err := a.apply(server.Client(), req)
+	if err == nil {
+		t.Fatal("expected a login error")
+	}
+	if !isAuthFailure(err) || !isRetryable(err) {
+		t.Errorf("a rejected login must be a retryable auth failure, got %#v", err)
+	}
+}
+
+func TestLoginRejectedDoesNotConsumeAttempts(t *testing.T) {
+	server := newRejectingLoginServer(t)
+	r, _ := newTestJournal(t)
+	cfg := r.config().routeConfig
+	cfg.authMode, cfg.loginURL = authJWTLogin, server.URL+"/login"
+	cfg.retry = retryPolicy{maxAttempts: 1, baseBackoff: time.Minute, maxBackoff: time.Hour}
+	r.settings.Store(newRouteSettings(cfg))
+
+	filePath := filepath.Join(cfg.sendDir, "a.txt")
+	writeTestFile(t, filePath, "hello")
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/upload", nil)
+	for i := 0; i < 3; i++ {
+		if !r.claimFile(filePath) {
+			t.Fatalf("attempt %d: the file is still claimed", i+1)
+		}
+		err := r.config().auth.apply(server.Client(), req)
+		if err == nil {
+			t.Fatal("expected a login error")
+		}
+		handleSendFailure(r, filePath, err)
+	}
+
+	if _, err := os.Stat(filePath); err != nil {
+		t.Fatalf("the file must stay in the send directory: %v", err)
+	}
+	if entries, _ := os.ReadDir(cfg.failedDir); len(entries) != 0 {
+		t.Errorf("the file must not be moved to the failed directory, it has %d entries", len(entries))
+	}
+	r.mu.Lock()
+	state := r.retries[filePath]
+	r.mu.Unlock()
+	if state.attempts != 0 || state.authFailures != 3 {
+		t.Errorf("got %d attempts and %d auth failures, want 0 and 3", state.attempts, state.authFailures)
+	}
+}
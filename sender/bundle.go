@@ -0,0 +1,489 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Форматы пакетов ([Bundle] Format)
+const (
+	bundleNone  = "none"
+	bundleZip   = "zip"
+	bundleTarGz = "tar.gz"
+)
+
+// bundleManifestName - список файлов пакета, записывается в пакет последним
+const bundleManifestName = "manifest.json"
+
+// bundleEndpoint - адрес приема пакетов относительно адреса загрузки. Сервер
+// распаковывает пакет, сверяет файлы с манифестом и сохраняет их по отдельности
+const bundleEndpoint = "/bundle"
+
+// bundleConfig - мелкие файлы собираются в один пакет в течение maxWait, пока
+// пакет не достигнет maxSize байт или maxFiles файлов
+type bundleConfig struct {
+	format      string
+	maxWait     time.Duration
+	maxSize     int64
+	maxFiles    int
+	maxFileSize int64 // файлы больше отправляются по отдельности
+}
+
+// bundleManifest - содержимое manifest.json
+type bundleManifest struct {
+	Created time.Time           `json:"created"`
+	Route   string              `json:"route"`
+	Files   []bundleFileSummary `json:"files"`
+}
+
+type bundleFileSummary struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"` // содержимого в пакете, при шифровании - зашифрованного
+
+	path        string // путь в каталоге отправки
+	plainSize   int64  // размер и SHA-256 исходного файла для журнала и архива
+	plainSHA256 string
+}
+
+// bundler накапливает файлы следующего пакета направления
+type bundler struct {
+	mu    sync.Mutex
+	files []bundledFile
+	size  int64
+
+	started chan struct{} // в пакет добавлен первый файл
+	full    chan struct{} // пакет достиг MaxSize или MaxFiles
+}
+
+type bundledFile struct {
+	path string
+	size int64
+}
+
+func newBundler() *bundler {
+	return &bundler{started: make(chan struct{}, 1), full: make(chan struct{}, 1)}
+}
+
+func trySignal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (b *bundler) add(cfg bundleConfig, filePath string, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.files = append(b.files, bundledFile{path: filePath, size: size})
+	b.size += size
+	if len(b.files) == 1 {
+		trySignal(b.started)
+	}
+	b.checkFullLocked(cfg)
+}
+
+func (b *bundler) checkFullLocked(cfg bundleConfig) {
+	if len(b.files) >= cfg.maxFiles || b.size >= cfg.maxSize {
+		trySignal(b.full)
+	}
+}
+
+// take забирает файлы следующего пакета в пределах MaxFiles и MaxSize, остальные
+// файлы переходят в следующий пакет
+func (b *bundler) take(cfg bundleConfig) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var paths []string
+	var size int64
+	n := 0
+	for n < len(b.files) && n < cfg.maxFiles && (n == 0 || size+b.files[n].size <= cfg.maxSize) {
+		paths = append(paths, b.files[n].path)
+		size += b.files[n].size
+		n++
+	}
+	b.files, b.size = b.files[n:], b.size-size
+
+	// Сигнал о заполнении мог остаться от забранных файлов
+	select {
+	case <-b.full:
+	default:
+	}
+	if len(b.files) > 0 {
+		trySignal(b.started)
+	}
+	b.checkFullLocked(cfg)
+	return paths
+}
+
+// remove убирает файл из следующего пакета
+func (b *bundler) remove(filePath string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, f := range b.files {
+		if f.path == filePath {
+			b.files = append(b.files[:i], b.files[i+1:]...)
+			b.size -= f.size
+			return true
+		}
+	}
+	return false
+}
+
+// pending возвращает файлы следующего пакета
+func (b *bundler) pending() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	paths := make([]string, 0, len(b.files))
+	for _, f := range b.files {
+		paths = append(paths, f.path)
+	}
+	return paths
+}
+
+// takeAll забирает все файлы при паузе, закрытии окна отправки и завершении работы
+func (b *bundler) takeAll() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	paths := make([]string, 0, len(b.files))
+	for _, f := range b.files {
+		paths = append(paths, f.path)
+	}
+	b.files, b.size = nil, 0
+	return paths
+}
+
+func (rc routeConfig) bundling() bool {
+	return rc.bundle.format != "" && rc.bundle.format != bundleNone
+}
+
+// usesStaging - StagingDir нужен для зашифрованных копий и для пакетов
+func (rc routeConfig) usesStaging() bool {
+	return len(rc.recipients) > 0 || rc.bundling()
+}
+
+// addToBundle откладывает мелкий файл до отправки пакета. Файлы, уже доставленные
+// ранее, обрабатываются обычным образом, чтобы сразу переместить их в архив.
+// Файл с именем манифеста пакета тоже отправляется отдельно
+func (r *route) addToBundle(filePath string) bool {
+	cfg := r.config()
+	if !cfg.bundling() || r.bundleUnsupported.Load() || r.relativePath(filePath) == bundleManifestName {
+		return false
+	}
+	info, err := os.Stat(filePath)
+	if err != nil || info.Size() > cfg.bundle.maxFileSize {
+		return false
+	}
+	if entry, ok := fileJournal.lookup(filePath); ok && entry.State == stateAcked && entry.sameFile(info) {
+		return false
+	}
+
+	r.bundle.add(cfg.bundle, filePath, info.Size())
+	return true
+}
+
+// runBundler отправляет пакет по истечении MaxWait после первого файла или сразу
+// после заполнения. При завершении работы неотправленные файлы остаются в каталоге
+func runBundler(r *route) {
+	// Пакеты, оставшиеся после аварийного завершения, собираются заново
+	leftovers, _ := filepath.Glob(filepath.Join(r.config().stagingDir, "bundle-*"))
+	for _, path := range leftovers {
+		_ = os.Remove(path)
+	}
+
+	timer := time.NewTimer(0)
+	<-timer.C
+	for {
+		select {
+		case <-stopping.Done():
+			for _, filePath := range r.bundle.takeAll() {
+				r.releaseFile(filePath)
+			}
+			return
+		case <-r.bundle.started:
+			timer.Reset(r.config().bundle.maxWait)
+			continue
+		case <-r.bundle.full:
+		case <-timer.C:
+		}
+		timer.Stop()
+		sendBundle(r, r.bundle.take(r.config().bundle))
+	}
+}
+
+// sendBundle упаковывает файлы, отправляет пакет и только после подтверждения
+// сервером перемещает каждый файл в архив. При ошибке повторная попытка назначается
+// каждому файлу отдельно
+func sendBundle(r *route, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	if stopping.Err() != nil {
+		for _, filePath := range paths {
+			r.releaseFile(filePath)
+		}
+		return
+	}
+	// Пока файлы ждали пакета, отправка могла быть приостановлена или окно
+	// отправки закрыться: такие файлы возвращаются в каталог до открытия окна
+	allowed := paths[:0]
+	for _, filePath := range paths {
+		if r.paused.Load() || !r.scheduleAllows(filePath) {
+			r.releaseFile(filePath)
+			continue
+		}
+		allowed = append(allowed, filePath)
+	}
+	if paths = allowed; len(paths) == 0 {
+		return
+	}
+
+	bundlePath, manifest, skipped, err := writeBundle(r, paths)
+	for filePath, skipErr := range skipped {
+		if os.IsNotExist(skipErr) {
+			r.releaseFile(filePath)
+		} else {
+			log.Error().Msg(fmt.Sprintf("error adding %s to the bundle: %v", filePath, skipErr))
+			handleSendFailure(r, filePath, skipErr)
+		}
+	}
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("Route %s: error creating a bundle: %v", r.name, err))
+		for _, filePath := range paths {
+			if _, ok := skipped[filePath]; !ok {
+				handleSendFailure(r, filePath, err)
+			}
+		}
+		return
+	}
+	defer os.Remove(bundlePath)
+	if len(manifest.Files) == 0 {
+		return
+	}
+
+	for _, f := range manifest.Files {
+		fileJournal.record(journalEntry{Path: f.path, State: stateInFlight, Size: f.plainSize, ModTime: f.ModTime})
+	}
+	log.Info().Msg(fmt.Sprintf("Starting bundle transfer: %s (%d files)", bundlePath, len(manifest.Files)))
+
+	// Пакет всегда передается одним запросом: его размер ограничен MaxSize, а
+	// файлы внутри при необходимости уже зашифрованы по отдельности
+	started := time.Now()
+	file, err := os.Open(bundlePath)
+	if err == nil {
+		size := int64(-1)
+		if stat, statErr := file.Stat(); statErr == nil {
+			size = stat.Size()
+		}
+		_, err = sendFileMultipart(r, file, r.config().serverAddr+bundleEndpoint, filepath.Base(bundlePath), size)
+		_ = file.Close()
+	}
+	var sendErr *sendError
+	if errors.As(err, &sendErr) && (sendErr.StatusCode == http.StatusNotFound || sendErr.StatusCode == http.StatusMethodNotAllowed) {
+		// Старый сервер без приема пакетов: файлы отправляются по одному
+		log.Error().Msg(fmt.Sprintf("Route %s: the server does not accept bundles (%d), files are sent one by one until the configuration is reloaded", r.name, sendErr.StatusCode))
+		r.bundleUnsupported.Store(true)
+		for _, f := range manifest.Files {
+			r.releaseFile(f.path)
+		}
+		return
+	}
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("error sending the bundle %s: %s", bundlePath, err))
+		for _, f := range manifest.Files {
+			if errors.Is(err, context.Canceled) {
+				r.releaseFile(f.path)
+			} else {
+				handleSendFailure(r, f.path, err)
+			}
+		}
+		return
+	}
+	metricUploadDuration.WithLabelValues(r.name).Observe(time.Since(started).Seconds())
+
+	for _, f := range manifest.Files {
+		acked := journalEntry{Path: f.path, State: stateAcked, SHA256: f.plainSHA256}
+		if f.SHA256 != f.plainSHA256 {
+			acked.EncryptedSHA256 = f.SHA256
+		}
+		fileJournal.record(acked)
+		r.recordSent(filepath.Base(f.path), f.plainSize)
+		moveToArchive(r, f.path)
+		if _, err := os.Stat(f.path); err == nil {
+			r.releaseFile(f.path)
+		}
+	}
+}
+
+// bundleWriter - запись файлов в zip или tar.gz
+type bundleWriter interface {
+	create(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+type zipBundle struct{ *zip.Writer }
+
+func (z zipBundle) create(name string, _ int64, modTime time.Time) (io.Writer, error) {
+	return z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+}
+
+type tarGzBundle struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t tarGzBundle) create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	return t.tw, t.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime})
+}
+
+func (t tarGzBundle) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// writeBundle создает пакет в StagingDir. Исчезнувшие и непрочитанные файлы
+// пропускаются и возвращаются в skipped вместе с ошибкой
+func writeBundle(r *route, paths []string) (string, bundleManifest, map[string]error, error) {
+	cfg := r.config()
+	manifest := bundleManifest{Created: time.Now(), Route: r.name}
+	skipped := make(map[string]error)
+
+	ext := ".zip"
+	if cfg.bundle.format == bundleTarGz {
+		ext = ".tar.gz"
+	}
+	out, err := os.CreateTemp(cfg.stagingDir, "bundle-"+time.Now().Format("20060102-150405")+"-*"+ext)
+	if err != nil {
+		return "", manifest, skipped, err
+	}
+
+	var writer bundleWriter
+	if cfg.bundle.format == bundleTarGz {
+		gz := gzip.NewWriter(out)
+		writer = tarGzBundle{tw: tar.NewWriter(gz), gz: gz}
+	} else {
+		writer = zipBundle{zip.NewWriter(out)}
+	}
+
+	for _, filePath := range paths {
+		summary, err := r.addBundleFile(writer, filePath)
+		var readErr *bundleReadError
+		if os.IsNotExist(err) || errors.As(err, &readErr) {
+			skipped[filePath] = err
+			continue
+		}
+		if err != nil {
+			// Ошибка записи самого пакета - пакет отменяется целиком
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+			return "", manifest, skipped, err
+		}
+		manifest.Files = append(manifest.Files, summary)
+	}
+
+	err = writeBundleManifest(writer, manifest)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return "", manifest, skipped, err
+	}
+	return out.Name(), manifest, skipped, nil
+}
+
+// bundleReadError - файл не удалось прочитать, сам пакет при этом не поврежден
+type bundleReadError struct{ err error }
+
+func (e *bundleReadError) Error() string { return e.err.Error() }
+func (e *bundleReadError) Unwrap() error { return e.err }
+
+// addBundleFile добавляет файл в пакет. При включенном шифровании в пакет
+// попадает зашифрованная копия name.age, как при отправке по одному
+func (r *route) addBundleFile(writer bundleWriter, filePath string) (bundleFileSummary, error) {
+	summary := bundleFileSummary{Name: filepath.ToSlash(r.relativePath(filePath)), path: filePath}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return summary, err
+		}
+		return summary, &bundleReadError{err}
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return summary, &bundleReadError{err}
+	}
+	summary.ModTime, summary.plainSize = info.ModTime(), info.Size()
+	plain, err := hashPrefix(file, info.Size())
+	if err != nil {
+		return summary, &bundleReadError{err}
+	}
+	summary.plainSHA256 = hex.EncodeToString(plain.Sum(nil))
+
+	content, size := file, info.Size()
+	if len(r.config().recipients) > 0 {
+		content, _, err = r.encryptedCopy(file, filePath)
+		if err != nil {
+			return summary, &bundleReadError{err}
+		}
+		defer content.Close()
+		if info, err := content.Stat(); err == nil {
+			size = info.Size()
+		}
+		summary.Name += encryptedExt
+	}
+	summary.Size = size
+
+	entry, err := writer.create(summary.Name, summary.Size, summary.ModTime)
+	if err != nil {
+		return summary, err
+	}
+	digest := sha256.New()
+	// В tar записывается ровно указанный в заголовке размер
+	if _, err := io.CopyN(io.MultiWriter(entry, digest), content, summary.Size); err != nil {
+		return summary, err
+	}
+	summary.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	return summary, nil
+}
+
+func writeBundleManifest(writer bundleWriter, manifest bundleManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	entry, err := writer.create(bundleManifestName, int64(len(data)), manifest.Created)
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestBundleRoute - направление с пакетами, отправляющее на тестовый сервер
+func newTestBundleRoute(t *testing.T, windows []string) (*route, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+
+	r, dir := newTestJournal(t)
+	cfg := r.config().routeConfig
+	cfg.serverAddr = server.URL + "/upload"
+	cfg.stagingDir = filepath.Join(dir, "staging")
+	if err := os.MkdirAll(cfg.stagingDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg.bundle = bundleConfig{format: bundleZip, maxWait: time.Hour, maxSize: 1 << 20, maxFiles: 10, maxFileSize: 1 << 10}
+	var err error
+	if cfg.schedule, err = parseSchedule(windows, nil, "UTC"); err != nil {
+		t.Fatal(err)
+	}
+	r.settings.Store(newRouteSettings(cfg))
+	return r, &requests
+}
+
+func (r *route) addTestBundleFile(t *testing.T, name string) string {
+	t.Helper()
+	filePath := filepath.Join(r.config().sendDir, name)
+	writeTestFile(t, filePath, "hello")
+	if !r.claimFile(filePath) || !r.addToBundle(filePath) {
+		t.Fatalf("%s was not added to the bundle", name)
+	}
+	return filePath
+}
+
+func (r *route) isClaimed(filePath string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.inFlight[filePath]
+}
+
+func TestReleaseQueuedReleasesBundledFiles(t *testing.T) {
+	r, _ := newTestBundleRoute(t, nil)
+	filePath := r.addTestBundleFile(t, "a.txt")
+
+	r.paused.Store(true)
+	r.releaseQueued(false)
+
+	if pending := r.bundle.pending(); len(pending) != 0 {
+		t.Errorf("bundle still holds %v after pause", pending)
+	}
+	if r.isClaimed(filePath) {
+		t.Error("the bundled file must be released on pause")
+	}
+}
+
+func TestSendBundleHoldsFilesOutsideWindow(t *testing.T) {
+	// Окно на одну минуту через два часа: сейчас отправка запрещена
+	now := time.Now().UTC().Add(2 * time.Hour)
+	window := now.Format("15:04") + "-" + now.Add(time.Minute).Format("15:04")
+	tests := []struct {
+		name    string
+		windows []string
+		paused  bool
+	}{
+		{name: "paused", paused: true},
+		{name: "window closed", windows: []string{window}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, requests := newTestBundleRoute(t, tt.windows)
+			r.paused.Store(tt.paused)
+			filePath := r.addTestBundleFile(t, "a.txt")
+
+			sendBundle(r, r.bundle.take(r.config().bundle))
+
+			if n := requests.Load(); n != 0 {
+				t.Errorf("%d requests sent, want none", n)
+			}
+			if r.isClaimed(filePath) {
+				t.Error("the file must be released")
+			}
+			r.mu.Lock()
+			_, retried := r.retries[filePath]
+			r.mu.Unlock()
+			if retried {
+				t.Error("holding a file back must not count as a failed attempt")
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// checksumMismatchCode - код ошибки в ответе сервера, если полученный файл не совпал
+// с контрольной суммой отправителя
+const checksumMismatchCode = "checksum_mismatch"
+
+// archiveManifestName - файл в каталоге архива за день со сведениями об отправленных файлах
+const archiveManifestName = "manifest.jsonl"
+
+// manifestMu - обработчики дописывают манифест архива по очереди
+var manifestMu sync.Mutex
+
+// archiveRecord - строка манифеста архива
+type archiveRecord struct {
+	Time       time.Time `json:"time"`
+	Route      string    `json:"route"`
+	File       string    `json:"file"`
+	ArchivedTo string    `json:"archived_to"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256,omitempty"`
+
+	// SHA-256 переданной зашифрованной копии, если включено шифрование
+	EncryptedSHA256 string `json:"encrypted_sha256,omitempty"`
+}
+
+// isChecksumMismatch - файл поврежден при передаче, отправку стоит повторить
+func isChecksumMismatch(statusCode int, body []byte) bool {
+	return statusCode == http.StatusUnprocessableEntity && bytes.Contains(body, []byte(checksumMismatchCode))
+}
+
+// checkEchoedChecksum сравнивает контрольную сумму, которую вернул сервер, с посчитанной
+// при отправке. Старые серверы сумму не возвращают, тогда проверка пропускается
+func checkEchoedChecksum(local, echoed string) error {
+	if echoed == "" || echoed == local {
+		return nil
+	}
+	return &sendError{Err: fmt.Errorf("checksum mismatch: sent %s, server stored %s", local, echoed), Retryable: true}
+}
+
+// hashPrefix считает SHA-256 первых n байт файла - при докачке они уже на сервере
+func hashPrefix(file *os.File, n int64) (hash.Hash, error) {
+	digest := sha256.New()
+	if _, err := io.Copy(digest, io.NewSectionReader(file, 0, n)); err != nil {
+		return nil, fmt.Errorf("error reading the file: %v", err)
+	}
+	return digest, nil
+}
+
+// writeArchiveManifest дописывает сведения о файле в манифест каталога архива за день
+func writeArchiveManifest(dayDir string, record archiveRecord) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("error encoding archive manifest record: %v", err))
+		return
+	}
+
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(dayDir, archiveManifestName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("error opening archive manifest: %v", err))
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Error().Msg(fmt.Sprintf("error writing archive manifest: %v", err))
+	}
+}
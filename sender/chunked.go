@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+)
+
+// chunkStatus - ответ сервера о состоянии частичной загрузки
+type chunkStatus struct {
+	Offset int64  `json:"offset"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Error  string `json:"error"`
+}
+
+// uploadIDFor вычисляет идентификатор загрузки по имени, размеру и времени изменения файла,
+// поэтому после перезапуска докачка продолжается с тем же идентификатором
+func uploadIDFor(filePath string, info os.FileInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", filePath, info.Size(), info.ModTime().UnixNano())))
+	return hex.EncodeToString(sum[:16])
+}
+
+// sendFileChunked отправляет файл частями по chunkSize байт, продолжая с последнего
+// подтвержденного сервером смещения. Возвращает SHA-256 файла, подтвержденную сервером
+func sendFileChunked(r *route, file *os.File, filePath, name string, size int64) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("error getting file info: %v", err)
+	}
+
+	uploadID := uploadIDFor(filePath, info)
+	if entry, ok := fileJournal.lookup(filePath); ok && entry.UploadID != "" && entry.sameFile(info) {
+		uploadID = entry.UploadID
+	}
+	chunkURL := fmt.Sprintf("%s/chunk/%s", r.config().serverAddr, uploadID)
+
+	// Запрашиваем у сервера, сколько байт уже получено
+	offset, err := queryChunkOffset(r, chunkURL)
+	if err != nil {
+		return "", err
+	}
+	if offset > 0 {
+		log.Info().Msg(fmt.Sprintf("Resuming upload of %s from offset %d of %d", filePath, offset, size))
+	}
+
+	// Уже принятая сервером часть файла хешируется локально, остальное - при отправке
+	digest, err := hashPrefix(file, offset)
+	if err != nil {
+		return "", err
+	}
+
+	for offset < size {
+		length := r.config().chunkSize
+		if size-offset < length {
+			length = size - offset
+		}
+
+		status, err := sendChunk(r, chunkURL, file, name, offset, length, size, digest)
+		if err != nil {
+			return "", err
+		}
+		// Сервер сохранил другое количество байт - пересчитываем сумму до его смещения
+		if status.Offset != offset+length {
+			if digest, err = hashPrefix(file, status.Offset); err != nil {
+				return "", err
+			}
+		}
+		offset = status.Offset
+
+		fileJournal.record(journalEntry{Path: filePath, State: stateInFlight, UploadID: uploadID, Offset: offset})
+	}
+
+	// Все части получены - просим сервер собрать файл и сверить контрольную сумму
+	checksum := hex.EncodeToString(digest.Sum(nil))
+	resp, err := r.do(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, chunkURL+"/complete", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Upload-SHA256", checksum)
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var status chunkStatus
+	if err := decodeChunkResponse(resp, &status); err != nil {
+		return "", err
+	}
+	if err := checkEchoedChecksum(checksum, status.SHA256); err != nil {
+		return "", err
+	}
+
+	log.Info().Msg(fmt.Sprintf("Chunked upload of %s completed: %s", filePath, status.Path))
+	return checksum, nil
+}
+
+// queryChunkOffset возвращает количество байт, уже сохраненных сервером
+func queryChunkOffset(r *route, chunkURL string) (int64, error) {
+	resp, err := r.do(func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, chunkURL, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+
+	var status chunkStatus
+	if err := decodeChunkResponse(resp, &status); err != nil {
+		return 0, err
+	}
+	return status.Offset, nil
+}
+
+// sendChunk передает часть файла начиная со смещения offset, добавляя ее в digest
+func sendChunk(r *route, chunkURL string, file *os.File, name string, offset, length, size int64, digest hash.Hash) (chunkStatus, error) {
+	var status chunkStatus
+
+	// Запрос может быть повторен после нового входа на сервер, поэтому каждая
+	// передача хеширует часть в свою копию digest
+	state, err := digest.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return status, err
+	}
+	var sent hash.Hash
+
+	// Смещения считаются по исходному файлу, сжимается только передаваемая часть
+	contentEncoding := r.config().contentEncoding(name)
+
+	resp, err := r.do(func() (*http.Request, error) {
+		sent = sha256.New()
+		if err := sent.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return nil, err
+		}
+		body := io.NopCloser(io.TeeReader(io.NewSectionReader(file, offset, length), sent))
+		contentLength := length
+		if contentEncoding != "" {
+			body, contentLength = compressBody(body, contentEncoding), -1
+		}
+		req, err := http.NewRequest(http.MethodPost, chunkURL, body)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = contentLength
+		req.Header.Set("Content-Type", "application/octet-stream")
+		if contentEncoding != "" {
+			req.Header.Set("Content-Encoding", contentEncoding)
+		}
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+		req.Header.Set("Upload-Name", url.PathEscape(filepath.Base(name)))
+		if r.config().recursive {
+			req.Header.Set("Upload-Path", url.PathEscape(filepath.ToSlash(name)))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+
+	// Сервер сохранил другое количество байт - продолжаем с его смещения
+	if resp.StatusCode == http.StatusConflict {
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			return status, newResponseError(resp.StatusCode, []byte(err.Error()))
+		}
+		log.Info().Msg(fmt.Sprintf("Server reported offset %d instead of %d, continuing from it", status.Offset, offset))
+		return status, nil
+	}
+
+	if err = decodeChunkResponse(resp, &status); err != nil {
+		return status, err
+	}
+
+	// Часть принята целиком - переносим ее хеш в digest
+	if status.Offset == offset+length {
+		if state, err = sent.(encoding.BinaryMarshaler).MarshalBinary(); err == nil {
+			err = digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+		}
+	}
+	return status, err
+}
+
+func decodeChunkResponse(resp *http.Response, status *chunkStatus) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return newNetworkError(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		log.Error().Msg(fmt.Sprintf("error receiving response from server: %s - %s", resp.Status, body))
+		return newResponseError(resp.StatusCode, body)
+	}
+
+	if err := json.Unmarshal(body, status); err != nil {
+		return fmt.Errorf("error decoding server response: %v", err)
+	}
+	return nil
+}
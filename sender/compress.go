@@ -0,0 +1,67 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Способы сжатия тела запроса, передаются серверу в Content-Encoding
+const (
+	compressNone = "none"
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// contentEncoding возвращает способ сжатия файла или пустую строку, если файл
+// передается как есть: сжатие отключено, файл уже сжат (SkipCompression) или
+// зашифрован - зашифрованные данные не сжимаются
+func (cfg *routeSettings) contentEncoding(fileName string) string {
+	if cfg.compression == "" || cfg.compression == compressNone {
+		return ""
+	}
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if ext == encryptedExt {
+		return ""
+	}
+	for _, skip := range cfg.skipCompression {
+		if strings.ToLower(skip) == ext {
+			return ""
+		}
+	}
+	return cfg.compression
+}
+
+// compressBody сжимает тело запроса на лету. Итоговый размер заранее неизвестен,
+// поэтому запрос передается с Transfer-Encoding: chunked
+func compressBody(body io.ReadCloser, encoding string) io.ReadCloser {
+	reader, writer := io.Pipe()
+	go func() {
+		encoder, err := newEncoder(writer, encoding)
+		if err == nil {
+			_, err = io.Copy(encoder, body)
+			if closeErr := encoder.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		_ = body.Close()
+		_ = writer.CloseWithError(err)
+	}()
+	return reader
+}
+
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case compressGzip:
+		return gzip.NewWriter(w), nil
+	case compressZstd:
+		// Файлы и так передаются несколькими обработчиками параллельно
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", encoding)
+	}
+}
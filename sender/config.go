@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/ini.v1"
+)
+
+// Префикс переменных окружения: SENDER_<SECTION>_<KEY>, например SENDER_SERVER_HOST
+const envPrefix = "SENDER_"
+
+// Типы значений параметров config.ini
+type valueKind int
+
+const (
+	kindString valueKind = iota
+	kindList             // значения через запятую
+	kindInt
+	kindFloat
+	kindBool
+	kindDuration // 2s, 5m, 1h
+	kindSize     // 512KB, 8MB, 1GB
+	kindChoice
+)
+
+// configKey - описание параметра: секция, тип, значение по умолчанию и ограничения
+type configKey struct {
+	section  string
+	name     string
+	kind     valueKind
+	def      string
+	choices  []string
+	min, max float64 // для kindInt и kindFloat, если max > min
+	positive bool    // для kindDuration: 0 и отрицательные значения не допускаются
+	secret   bool    // значение скрывается в --print-config
+	global   bool    // параметр программы, не направления: в [Route.<name>] не задается
+}
+
+// configSchema - все параметры config.ini. Значения по умолчанию берутся только отсюда
+var configSchema = []configKey{
+	{section: "Server", name: "Host", def: "transport.ipay.ua"},
+	{section: "Server", name: "Port", kind: kindInt, def: "14080", min: 1, max: 65535},
+	{section: "Server", name: "Context", def: "upload"},
+	{section: "Server", name: "UseHTTPS", kind: kindBool, def: "true"},
+	{section: "Server", name: "CertFile"},
+	{section: "Server", name: "KeyFile"},
+	{section: "Server", name: "CAFile"},
+	{section: "Server", name: "ServerPins", kind: kindList},
+	{section: "Server", name: "MinTLSVersion", kind: kindChoice, def: "1.2", choices: []string{"1.0", "1.1", "1.2", "1.3"}},
+
+	{section: "Auth", name: "Mode", kind: kindChoice, def: authJWTLogin, choices: []string{authBasic, authJWTLogin, authBearer, authNone}},
+	{section: "Auth", name: "Username", def: "admin"},
+	{section: "Auth", name: "Password", def: "password", secret: true},
+	{section: "Auth", name: "Token", secret: true},
+	{section: "Auth", name: "LoginURL"},
+
+	{section: "Directories", name: "SendDir", def: "./send/"},
+	{section: "Directories", name: "ArchiveDir", def: "./archive/"},
+	{section: "Directories", name: "FailedDir", def: "./failed/"},
+	{section: "Directories", name: "LogDir", def: "./logs/", global: true},
+	{section: "Directories", name: "IgnoredDir"},
+	{section: "Directories", name: "Include", kind: kindList},
+	{section: "Directories", name: "Exclude", kind: kindList},
+	{section: "Directories", name: "IncludeRegex"},
+	{section: "Directories", name: "ExcludeRegex"},
+	{section: "Directories", name: "Recursive", kind: kindBool, def: "false"},
+	{section: "Directories", name: "WatchMode", kind: kindChoice, def: "auto", choices: []string{"auto", "notify", "poll"}},
+	{section: "Directories", name: "PollInterval", kind: kindDuration, def: "1s", positive: true},
+	{section: "Directories", name: "RescanInterval", kind: kindDuration, def: "1m", positive: true},
+	{section: "Directories", name: "Readiness", kind: kindChoice, def: readyStable, choices: []string{readyAge, readyStable, readyExclusive, readyMarker}},
+	{section: "Directories", name: "MinFileAge", kind: kindDuration, def: "2s"},
+	{section: "Directories", name: "StableScans", kind: kindInt, def: "3", min: 1, max: 1000},
+	{section: "Directories", name: "MarkerSuffixes", kind: kindList, def: ".done,.ready"},
+	{section: "Directories", name: "TempSuffixes", kind: kindList, def: ".tmp,.part"},
+
+	{section: "File", name: "LogFile", def: "app_daily.log", global: true},
+	{section: "File", name: "WatchConfig", kind: kindBool, def: "false", global: true},
+
+	{section: "Goroutines", name: "numWorkers", kind: kindInt, def: "8", min: 1, max: 1000},
+	{section: "Goroutines", name: "ShutdownGrace", kind: kindDuration, def: "30s", global: true},
+
+	{section: "Upload", name: "ChunkSize", kind: kindSize, def: "0"},
+	{section: "Upload", name: "ChunkThreshold", kind: kindSize, def: "64MB"},
+	{section: "Upload", name: "Compression", kind: kindChoice, def: compressNone, choices: []string{compressNone, compressGzip, compressZstd}},
+	{section: "Upload", name: "SkipCompression", kind: kindList, def: ".jpg,.jpeg,.png,.gif,.webp,.zip,.gz,.tgz,.bz2,.xz,.zst,.7z,.rar,.mp3,.mp4"},
+
+	{section: "Retry", name: "MaxAttempts", kind: kindInt, def: "5", min: 1, max: 1000},
+	{section: "Retry", name: "BaseBackoff", kind: kindDuration, def: "2s", positive: true},
+	{section: "Retry", name: "MaxBackoff", kind: kindDuration, def: "5m", positive: true},
+	{section: "Retry", name: "Jitter", kind: kindFloat, def: "0.2", min: 0, max: 1},
+
+	{section: "Priority", name: "Rules", kind: kindList}, // пусто - в порядке готовности
+	{section: "Priority", name: "Order", kind: kindChoice, def: orderFIFO, choices: []string{orderFIFO, orderSmallest, orderLargest, orderOldest}},
+	{section: "Priority", name: "HighPriority", kind: kindInt, def: "1"},
+	{section: "Priority", name: "ReservedWorkers", kind: kindInt, def: "0", min: 0, max: 1000},
+
+	{section: "Schedule", name: "Windows", kind: kindList}, // пусто - отправка в любое время
+	{section: "Schedule", name: "Blackout", kind: kindList},
+	{section: "Schedule", name: "TimeZone", def: "Local"},
+
+	{section: "Bundle", name: "Format", kind: kindChoice, def: bundleNone, choices: []string{bundleNone, bundleZip, bundleTarGz}}, // сервер должен принимать пакеты: POST <Context>/bundle
+	{section: "Bundle", name: "MaxWait", kind: kindDuration, def: "10s", positive: true},
+	{section: "Bundle", name: "MaxSize", kind: kindSize, def: "8MB"},
+	{section: "Bundle", name: "MaxFiles", kind: kindInt, def: "500", min: 1, max: 100000},
+	{section: "Bundle", name: "MaxFileSize", kind: kindSize, def: "1MB"}, // файлы больше отправляются по отдельности
+
+	{section: "Limits", name: "TotalBandwidth", kind: kindSize, def: "0", global: true}, // байт в секунду на все направления, 0 - без ограничения
+	{section: "Limits", name: "Bandwidth", kind: kindSize, def: "0"},
+	{section: "Limits", name: "MaxConcurrent", kind: kindInt, def: "0", min: 0, max: 1000},
+
+	{section: "Encryption", name: "Recipients", kind: kindList}, // пусто и нет RecipientsFile - шифрование отключено
+	{section: "Encryption", name: "RecipientsFile"},
+	{section: "Encryption", name: "StagingDir", def: "./staging/"},
+
+	{section: "Archive", name: "KeepRawDays", kind: kindInt, def: "0", min: 0, max: 100000},     // 0 - не сжимать
+	{section: "Archive", name: "DeleteAfterDays", kind: kindInt, def: "0", min: 0, max: 100000}, // 0 - не удалять
+	{section: "Archive", name: "MaxTotalSize", kind: kindSize, def: "0"},
+	{section: "Archive", name: "DryRun", kind: kindBool, def: "false"},
+	{section: "Archive", name: "CheckInterval", kind: kindDuration, def: "1h", positive: true},
+
+	{section: "Metrics", name: "Listen", global: true}, // пусто - метрики отключены
+	{section: "Metrics", name: "Path", def: "/metrics", global: true},
+
+	{section: "Admin", name: "Listen", global: true}, // только loopback, пусто - API отключено
+}
+
+// senderConfig - итоговая конфигурация программы
+type senderConfig struct {
+	logDir      string
+	logFile     string
+	watchConfig bool
+	routes      []routeConfig
+
+	metricsListen string
+	metricsPath   string
+	adminListen   string
+
+	shutdownGrace  time.Duration
+	totalBandwidth int64
+}
+
+// configSource - откуда читается конфигурация: файл и значения из командной строки
+type configSource struct {
+	path     string
+	explicit bool     // путь задан флагом --config, поэтому файл обязателен
+	set      []string // Section.Key=value
+}
+
+// listFlag - флаг командной строки, который можно указать несколько раз
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func findConfigKey(section, name string) (configKey, bool) {
+	if strings.HasPrefix(section, routeSectionPrefix) {
+		section = ""
+	}
+	for _, key := range configSchema {
+		if key.name == name && (key.section == section || (section == "" && !key.global)) {
+			return key, true
+		}
+	}
+	return configKey{}, false
+}
+
+// loadConfigFile собирает конфигурацию в порядке приоритета: значения по умолчанию,
+// config.ini, переменные окружения SENDER_*, флаги -set. Файл на диске не изменяется
+func loadConfigFile(src configSource) (*ini.File, error) {
+	cfg := ini.Empty()
+	if _, err := os.Stat(src.path); err == nil || src.explicit {
+		if cfg, err = ini.Load(src.path); err != nil {
+			return nil, fmt.Errorf("error loading %s: %v", src.path, err)
+		}
+	} else {
+		log.Info().Msg(fmt.Sprintf("The %s file was not found, using default settings", src.path))
+	}
+
+	for _, key := range configSchema {
+		section := cfg.Section(key.section)
+		if !section.HasKey(key.name) {
+			section.Key(key.name).SetValue(key.def)
+		}
+		env := envPrefix + strings.ToUpper(key.section+"_"+key.name)
+		if value, ok := os.LookupEnv(env); ok {
+			section.Key(key.name).SetValue(value)
+		}
+	}
+
+	for _, item := range src.set {
+		name, value, ok := strings.Cut(item, "=")
+		dot := strings.LastIndex(name, ".")
+		if !ok || dot <= 0 || dot == len(name)-1 {
+			return nil, fmt.Errorf("invalid -set value %q, expected Section.Key=value", item)
+		}
+		cfg.Section(name[:dot]).Key(name[dot+1:]).SetValue(value)
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validateConfig проверяет значения всех секций и возвращает все найденные ошибки
+func validateConfig(cfg *ini.File) error {
+	var errs []error
+	for _, section := range cfg.Sections() {
+		if section.Name() == ini.DefaultSection && len(section.Keys()) == 0 {
+			continue
+		}
+		for _, k := range section.Keys() {
+			key, ok := findConfigKey(section.Name(), k.Name())
+			if !ok {
+				log.Info().Msg(fmt.Sprintf("Unknown config key [%s] %s is ignored", section.Name(), k.Name()))
+				continue
+			}
+			if err := key.validate(k); err != nil {
+				errs = append(errs, fmt.Errorf("[%s] %s: %v", section.Name(), k.Name(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (key configKey) validate(k *ini.Key) error {
+	value := k.String()
+	switch key.kind {
+	case kindInt, kindFloat:
+		var n float64
+		var err error
+		if key.kind == kindInt {
+			var i int
+			i, err = strconv.Atoi(strings.TrimSpace(value))
+			n = float64(i)
+		} else {
+			n, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		}
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		if key.max > key.min && (n < key.min || n > key.max) {
+			return fmt.Errorf("%s is out of range %g..%g", value, key.min, key.max)
+		}
+	case kindBool:
+		if _, err := k.Bool(); err != nil {
+			return fmt.Errorf("%q is not a boolean (true or false)", value)
+		}
+	case kindDuration:
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("%q is not a duration (examples: 2s, 5m, 1h)", value)
+		}
+		if key.positive && d <= 0 {
+			return fmt.Errorf("%s must be positive", value)
+		}
+	case kindSize:
+		if _, err := parseSize(value); err != nil {
+			return err
+		}
+	case kindChoice:
+		for _, choice := range key.choices {
+			if value == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(key.choices, ", "))
+	}
+	return nil
+}
+
+// parseSize разбирает размер вида 512KB, 8MB, 1GB или число байт
+func parseSize(raw string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(raw))
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			multiplier = unit.size
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size (examples: 512KB, 8MB, 1GB)", raw)
+	}
+	return n * multiplier, nil
+}
+
+// loadConfig читает и проверяет конфигурацию программы и всех направлений
+func loadConfig(src configSource) (*senderConfig, *ini.File, error) {
+	cfg, err := loadConfigFile(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	routes, err := loadRoutes(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if listen := cfg.Section("Admin").Key("Listen").String(); listen != "" {
+		if err := checkAdminListen(listen); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Значение уже проверено в validateConfig
+	bandwidth, _ := parseSize(cfg.Section("Limits").Key("TotalBandwidth").String())
+
+	return &senderConfig{
+		logDir:      cfg.Section("Directories").Key("LogDir").String(),
+		logFile:     cfg.Section("File").Key("LogFile").String(),
+		watchConfig: cfg.Section("File").Key("WatchConfig").MustBool(),
+		routes:      routes,
+
+		metricsListen: cfg.Section("Metrics").Key("Listen").String(),
+		metricsPath:   cfg.Section("Metrics").Key("Path").String(),
+		adminListen:   cfg.Section("Admin").Key("Listen").String(),
+
+		shutdownGrace:  cfg.Section("Goroutines").Key("ShutdownGrace").MustDuration(),
+		totalBandwidth: bandwidth,
+	}, cfg, nil
+}
+
+// printConfig выводит итоговые значения параметров, включая значения по умолчанию
+// и переопределения. Для направлений выводятся значения с учетом общих секций
+func printConfig(w io.Writer, cfg *ini.File) {
+	writeSection := func(name string, value func(key configKey) string, routeOnly bool) {
+		fmt.Fprintf(w, "[%s]\n", name)
+		for _, key := range configSchema {
+			if routeOnly && key.global {
+				continue
+			}
+			if !routeOnly && key.section != name {
+				continue
+			}
+			v := value(key)
+			if key.secret && v != "" {
+				v = "********"
+			}
+			fmt.Fprintf(w, "%s = %s\n", key.name, v)
+		}
+		fmt.Fprintln(w)
+	}
+
+	var sections []string
+	for _, key := range configSchema {
+		if len(sections) == 0 || sections[len(sections)-1] != key.section {
+			sections = append(sections, key.section)
+		}
+	}
+	for _, name := range sections {
+		writeSection(name, func(key configKey) string {
+			return cfg.Section(key.section).Key(key.name).String()
+		}, false)
+	}
+
+	for _, section := range cfg.Sections() {
+		if !strings.HasPrefix(section.Name(), routeSectionPrefix) {
+			continue
+		}
+		k := routeKeys{cfg: cfg, section: section}
+		writeSection(section.Name(), func(key configKey) string {
+			return k.key(key.section, key.name).String()
+		}, true)
+	}
+}
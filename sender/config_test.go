@@ -0,0 +1,71 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    int64
+		wantErr bool
+	}{
+		{raw: "", want: 0},
+		{raw: "  ", want: 0},
+		{raw: "0", want: 0},
+		{raw: "1024", want: 1024},
+		{raw: "100B", want: 100},
+		{raw: "512KB", want: 512 << 10},
+		{raw: "8MB", want: 8 << 20},
+		{raw: "1GB", want: 1 << 30},
+		{raw: "8mb", want: 8 << 20},
+		{raw: " 8 MB ", want: 8 << 20},
+		{raw: "100GB", want: 100 << 30},
+		{raw: "1.5MB", wantErr: true},
+		{raw: "-1", wantErr: true},
+		{raw: "-1KB", wantErr: true},
+		{raw: "MB", wantErr: true},
+		{raw: "8M", wantErr: true},
+		{raw: "1TB", wantErr: true},
+		{raw: "ten", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, expected an error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSize(%q): %v", tt.raw, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestDurationsMustBePositive(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "config.ini")
+	for _, key := range []string{
+		"Directories.PollInterval", "Directories.RescanInterval", "Retry.BaseBackoff",
+		"Retry.MaxBackoff", "Bundle.MaxWait", "Archive.CheckInterval", "Route.a.PollInterval",
+	} {
+		for _, value := range []string{"0s", "-1s"} {
+			src := configSource{path: missing, set: []string{key + "=" + value}}
+			if _, err := loadConfigFile(src); err == nil || !strings.Contains(err.Error(), "must be positive") {
+				t.Errorf("%s=%s: expected an error, got %v", key, value, err)
+			}
+		}
+	}
+
+	// Нулевая задержка допустима там, где она что-то означает
+	src := configSource{path: missing, set: []string{"Directories.MinFileAge=0s", "Goroutines.ShutdownGrace=0s"}}
+	if _, err := loadConfigFile(src); err != nil {
+		t.Errorf("zero MinFileAge and ShutdownGrace must be accepted: %v", err)
+	}
+}
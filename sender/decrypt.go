@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// runDecrypt - команда sender decrypt: расшифровывает файлы .age закрытым ключом
+// получателя. Результат записывается рядом с файлом или в каталог -out без суффикса .age
+func runDecrypt(args []string) int {
+	flags := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: sender decrypt -identity key.txt [-out dir] file.age...\n")
+		flags.PrintDefaults()
+	}
+	identityPath := flags.String("identity", "", "file with age identities (private keys), as written by age-keygen")
+	outDir := flags.String("out", "", "directory for decrypted files, by default next to the encrypted ones")
+	_ = flags.Parse(args)
+
+	if *identityPath == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	identities, err := loadIdentities(*identityPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading identities: %v\n", err)
+		return 1
+	}
+
+	status := 0
+	for _, path := range flags.Args() {
+		dest, err := decryptFile(path, *outDir, identities)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s -> %s\n", path, dest)
+	}
+	return status
+}
+
+func loadIdentities(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return age.ParseIdentities(file)
+}
+
+// decryptFile расшифровывает файл во временный файл и переименовывает его, поэтому
+// при ошибке (чужой ключ, поврежденный файл) неполный результат не остается.
+// Существующие файлы не перезаписываются
+func decryptFile(path, outDir string, identities []age.Identity) (string, error) {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, encryptedExt) {
+		return "", fmt.Errorf("not an %s file", encryptedExt)
+	}
+	dir := filepath.Dir(path)
+	if outDir != "" {
+		dir = outDir
+	}
+	dest := filepath.Join(dir, strings.TrimSuffix(name, encryptedExt))
+	if _, err := os.Stat(dest); err == nil {
+		return "", fmt.Errorf("%s already exists", dest)
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	reader, err := age.Decrypt(src, identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return "", errors.New("the file was not encrypted for any of the given identities")
+		}
+		return "", err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".decrypt-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return dest, os.Rename(tmp.Name(), dest)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/rs/zerolog/log"
+)
+
+// encryptedExt добавляется к имени зашифрованного файла на сервере
+const encryptedExt = ".age"
+
+// loadRecipients разбирает открытые ключи age из [Encryption] Recipients и файла
+// RecipientsFile (по ключу в строке, # - комментарий)
+func loadRecipients(keys []string, file string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, key := range keys {
+		recipient, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("[Encryption] Recipients: %v", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("[Encryption] RecipientsFile: %v", err)
+		}
+		defer f.Close()
+		parsed, err := age.ParseRecipients(f)
+		if err != nil {
+			return nil, fmt.Errorf("[Encryption] RecipientsFile %s: %v", file, err)
+		}
+		recipients = append(recipients, parsed...)
+	}
+	return recipients, nil
+}
+
+// stagedPath - имя зашифрованной копии зависит от файла и получателей, поэтому после
+// перезапуска докачка продолжается с той же копией, а после смены ключей файл шифруется заново
+func (cfg *routeSettings) stagedPath(filePath string, info os.FileInfo) string {
+	var keys []string
+	for _, recipient := range cfg.recipients {
+		keys = append(keys, fmt.Sprint(recipient))
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s", filePath, info.Size(), info.ModTime().UnixNano(), strings.Join(keys, ","))))
+	return filepath.Join(cfg.stagingDir, hex.EncodeToString(sum[:16])+encryptedExt)
+}
+
+// encryptedCopy возвращает зашифрованную копию файла, создавая ее при необходимости.
+// Копия записывается во временный файл и переименовывается, чтобы не отправить недописанную.
+// Также возвращается SHA-256 исходного файла для журнала и манифеста архива
+func (r *route) encryptedCopy(file *os.File, filePath string) (*os.File, string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, "", fmt.Errorf("error getting file info: %v", err)
+	}
+	cfg := r.config()
+	staged := cfg.stagedPath(filePath, info)
+	if existing, err := os.Open(staged); err == nil {
+		// Копия осталась от прошлой попытки, исходный файл хешируется отдельно
+		digest, err := hashPrefix(file, info.Size())
+		if err != nil {
+			_ = existing.Close()
+			return nil, "", err
+		}
+		return existing, hex.EncodeToString(digest.Sum(nil)), nil
+	}
+
+	tmp, err := os.CreateTemp(cfg.stagingDir, "*.tmp")
+	if err != nil {
+		return nil, "", fmt.Errorf("error creating encrypted copy: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	// SHA-256 исходного файла считается при шифровании
+	digest := sha256.New()
+	err = encryptTo(tmp, io.TeeReader(file, digest), cfg.recipients)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), staged)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("error encrypting %s: %v", filePath, err)
+	}
+
+	log.Info().Msg(fmt.Sprintf("File %s encrypted for %d recipient(s)", filePath, len(cfg.recipients)))
+	encrypted, err := os.Open(staged)
+	if err != nil {
+		return nil, "", err
+	}
+	return encrypted, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func encryptTo(dst io.Writer, src io.Reader, recipients []age.Recipient) error {
+	writer, err := age.Encrypt(dst, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, src); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// removeStaged удаляет зашифрованную копию, когда файл перемещается в архив или
+// в каталог неотправленных
+func (r *route) removeStaged(filePath string) {
+	cfg := r.config()
+	if len(cfg.recipients) == 0 {
+		return
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return
+	}
+	if err := os.Remove(cfg.stagedPath(filePath, info)); err != nil && !os.IsNotExist(err) {
+		log.Error().Msg(fmt.Sprintf("error removing encrypted copy of %s: %v", filePath, err))
+	}
+}
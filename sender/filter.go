@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/rs/zerolog/log"
+)
+
+// fileFilter - правила отбора файлов по имени для каталога отправки
+type fileFilter struct {
+	include      []string // шаблоны вида *.txt
+	exclude      []string
+	includeRegex *regexp.Regexp
+	excludeRegex *regexp.Regexp
+	ignoredDir   string // каталог для исключенных файлов, если пусто - файлы остаются на месте
+}
+
+// newFileFilter проверяет шаблоны и компилирует регулярные выражения
+func newFileFilter(include, exclude []string, includeRegex, excludeRegex, ignoredDir string) (fileFilter, error) {
+	f := fileFilter{include: include, exclude: exclude, ignoredDir: ignoredDir}
+
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return f, fmt.Errorf("invalid file pattern %q: %v", pattern, err)
+		}
+	}
+
+	var err error
+	if includeRegex != "" {
+		if f.includeRegex, err = regexp.Compile(includeRegex); err != nil {
+			return f, fmt.Errorf("invalid IncludeRegex: %v", err)
+		}
+	}
+	if excludeRegex != "" {
+		if f.excludeRegex, err = regexp.Compile(excludeRegex); err != nil {
+			return f, fmt.Errorf("invalid ExcludeRegex: %v", err)
+		}
+	}
+
+	return f, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allows проверяет имя файла: если заданы правила Include, имя должно подойти
+// хотя бы под одно из них, и не должно подходить ни под одно правило Exclude
+func (f fileFilter) allows(name string) bool {
+	if len(f.include) > 0 || f.includeRegex != nil {
+		included := matchAny(f.include, name) ||
+			(f.includeRegex != nil && f.includeRegex.MatchString(name))
+		if !included {
+			return false
+		}
+	}
+
+	if matchAny(f.exclude, name) {
+		return false
+	}
+	return f.excludeRegex == nil || !f.excludeRegex.MatchString(name)
+}
+
+// ignoreFile записывает в лог исключенный файл один раз и при необходимости
+// переносит его в IgnoredDir
+func ignoreFile(r *route, filePath string) {
+	r.mu.Lock()
+	logged := r.ignored[filePath]
+	r.ignored[filePath] = true
+	r.mu.Unlock()
+
+	if logged {
+		return
+	}
+
+	ignoredDir := r.config().filter.ignoredDir
+	if ignoredDir == "" {
+		log.Info().Msg(fmt.Sprintf("The file %s is excluded by filters and will not be sent", filePath))
+		return
+	}
+
+	if err := os.MkdirAll(ignoredDir, 0755); err != nil {
+		log.Error().Msg(fmt.Sprintf("error creating directory: %s", err))
+		return
+	}
+	destPath := uniqueDestPath(ignoredDir, filepath.Base(filePath))
+	if err := os.Rename(filePath, destPath); err != nil {
+		log.Error().Msg(fmt.Sprintf("error moving excluded file: %s", err))
+		return
+	}
+	log.Info().Msg(fmt.Sprintf("The file %s is excluded by filters, moved to %s", filePath, destPath))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Состояния файла в журнале доставки
+type fileState string
+
+const (
+	stateDetected fileState = "detected"
+	stateInFlight fileState = "in-flight"
+	stateAcked    fileState = "acknowledged"
+	stateArchived fileState = "archived"
+	stateFailed   fileState = "failed"
+	stateRemoved  fileState = "removed"
+)
+
+// Количество устаревших записей, после которого журнал переписывается
+const journalCompactThreshold = 10000
+
+const journalFileName = "journal.jsonl"
+
+// journalEntry - одна запись журнала о состоянии файла
+type journalEntry struct {
+	Time       time.Time `json:"time"`
+	Path       string    `json:"path"`
+	State      fileState `json:"state"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	FirstSeen  time.Time `json:"first_seen"`
+	Attempts   int       `json:"attempts,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ArchivedTo string    `json:"archived_to,omitempty"`
+	UploadID   string    `json:"upload_id,omitempty"`
+	Offset     int64     `json:"offset,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"` // содержимого исходного файла
+
+	EncryptedSHA256 string `json:"encrypted_sha256,omitempty"` // переданной зашифрованной копии
+}
+
+// sameFile проверяет, что запись относится к тому же содержимому файла,
+// а не к новому файлу с тем же именем
+func (e journalEntry) sameFile(info os.FileInfo) bool {
+	return e.Size == info.Size() && e.ModTime.Equal(info.ModTime())
+}
+
+// journal - журнал доставки файлов (append-only, одна JSON-запись на строку)
+type journal struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	entries  map[string]journalEntry
+	obsolete int
+}
+
+var fileJournal *journal
+
+// openJournal загружает журнал из файла, сжимает его и открывает для дозаписи
+func openJournal(dir string) (*journal, error) {
+	j := &journal{
+		path:    filepath.Join(dir, journalFileName),
+		entries: make(map[string]journalEntry),
+	}
+
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.compactLocked(); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// replay читает все записи журнала, оставляя последнее состояние каждого файла
+func (j *journal) replay() error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening the journal: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Последняя строка могла быть записана не полностью при аварийном завершении
+			log.Error().Msg(fmt.Sprintf("skipping damaged journal record at line %d: %v", line, err))
+			continue
+		}
+		j.entries[entry.Path] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading the journal: %v", err)
+	}
+
+	return nil
+}
+
+// compactLocked переписывает журнал, оставляя только незавершенные файлы
+func (j *journal) compactLocked() error {
+	for path, entry := range j.entries {
+		if entry.State == stateArchived || entry.State == stateRemoved {
+			delete(j.entries, path)
+		}
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating the journal: %v", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range j.entries {
+		if err := encoder.Encode(entry); err != nil {
+			_ = tmp.Close()
+			return fmt.Errorf("error writing the journal: %v", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error writing the journal: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("error syncing the journal: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error closing the journal: %v", err)
+	}
+
+	if j.file != nil {
+		_ = j.file.Close()
+		j.file = nil
+	}
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("error replacing the journal: %v", err)
+	}
+
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening the journal: %v", err)
+	}
+	j.obsolete = 0
+
+	return nil
+}
+
+// record дописывает новое состояние файла в журнал и сбрасывает его на диск
+func (j *journal) record(entry journalEntry) {
+	entry.Time = time.Now()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if prev, ok := j.entries[entry.Path]; ok {
+		if entry.FirstSeen.IsZero() {
+			entry.FirstSeen = prev.FirstSeen
+		}
+		if entry.Attempts == 0 {
+			entry.Attempts = prev.Attempts
+		}
+		if entry.UploadID == "" {
+			entry.UploadID = prev.UploadID
+			entry.Offset = prev.Offset
+		}
+		if entry.SHA256 == "" {
+			entry.SHA256 = prev.SHA256
+			entry.EncryptedSHA256 = prev.EncryptedSHA256
+		}
+		if entry.Size == 0 && entry.ModTime.IsZero() {
+			entry.Size = prev.Size
+			entry.ModTime = prev.ModTime
+		}
+		j.obsolete++
+	}
+	j.entries[entry.Path] = entry
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("error encoding journal record: %v", err))
+		return
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		log.Error().Msg(fmt.Sprintf("error writing the journal: %v", err))
+		return
+	}
+	if err := j.file.Sync(); err != nil {
+		log.Error().Msg(fmt.Sprintf("error syncing the journal: %v", err))
+	}
+
+	if entry.State == stateArchived || entry.State == stateRemoved {
+		delete(j.entries, entry.Path)
+	}
+	if j.obsolete >= journalCompactThreshold {
+		if err := j.compactLocked(); err != nil {
+			log.Error().Msg(fmt.Sprintf("error compacting the journal: %v", err))
+		}
+	}
+}
+
+// lookup возвращает последнее известное состояние файла
+func (j *journal) lookup(path string) (journalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry, ok := j.entries[path]
+	return entry, ok
+}
+
+// pending возвращает все файлы, обработка которых не была завершена
+func (j *journal) pending() []journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entries := make([]journalEntry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (j *journal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.file != nil {
+		_ = j.file.Close()
+		j.file = nil
+	}
+}
+
+// resumeFromJournal восстанавливает состояние после перезапуска программы
+func resumeFromJournal() {
+	for _, entry := range fileJournal.pending() {
+		r := routeForPath(entry.Path)
+		info, err := os.Stat(entry.Path)
+		if r == nil || err != nil || !entry.sameFile(info) {
+			log.Info().Msg(fmt.Sprintf("Journal record is outdated, the file is missing or has been replaced: %s", entry.Path))
+			fileJournal.record(journalEntry{Path: entry.Path, State: stateRemoved})
+			continue
+		}
+
+		switch entry.State {
+		case stateAcked:
+			// Файл уже доставлен, осталось только переместить его в архив
+			log.Info().Msg(fmt.Sprintf("The file %s was delivered before restart, moving to archive", entry.Path))
+			moveToArchive(r, entry.Path)
+			continue
+		case stateInFlight:
+			log.Info().Msg(fmt.Sprintf("The file %s was in flight before restart, it will be sent again", entry.Path))
+		case stateFailed:
+			log.Info().Msg(fmt.Sprintf("The file %s failed %d times before restart, retrying", entry.Path, entry.Attempts))
+			r.restoreRetry(entry)
+		default:
+			log.Info().Msg(fmt.Sprintf("Resuming tracking of the file %s (%s)", entry.Path, entry.State))
+		}
+
+		r.mu.Lock()
+		r.firstSeen[entry.Path] = entry.FirstSeen
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestJournal создает направление с временными каталогами и открывает журнал
+func newTestJournal(t *testing.T) (*route, string) {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := routeConfig{
+		name:       "test",
+		sendDir:    filepath.Join(dir, "send"),
+		archiveDir: filepath.Join(dir, "archive"),
+		failedDir:  filepath.Join(dir, "failed"),
+		numWorkers: 1,
+	}
+	for _, d := range []string{cfg.sendDir, cfg.archiveDir, cfg.failedDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := newRoute(cfg)
+	routes = []*route{r}
+	reopenJournal(t, dir)
+	t.Cleanup(func() {
+		fileJournal.close()
+		routes = nil
+	})
+	return r, dir
+}
+
+// reopenJournal имитирует перезапуск программы
+func reopenJournal(t *testing.T, dir string) {
+	t.Helper()
+	if fileJournal != nil {
+		fileJournal.close()
+	}
+	var err error
+	if fileJournal, err = openJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) os.FileInfo {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func journalLines(t *testing.T, dir string) int {
+	t.Helper()
+	file, err := os.Open(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		lines++
+	}
+	return lines
+}
+
+func TestJournalReplaySkipsTruncatedLine(t *testing.T) {
+	dir := t.TempDir()
+	content := `{"path":"send/a.txt","state":"in-flight","size":3}
+{"path":"send/b.txt","state":"failed","attempts":2}
+{"path":"send/c.txt","sta`
+	if err := os.WriteFile(filepath.Join(dir, journalFileName), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := openJournal(dir)
+	if err != nil {
+		t.Fatalf("openJournal: %v", err)
+	}
+	defer j.close()
+
+	if entry, ok := j.lookup("send/a.txt"); !ok || entry.State != stateInFlight || entry.Size != 3 {
+		t.Errorf("a.txt: got %+v, %v", entry, ok)
+	}
+	if entry, ok := j.lookup("send/b.txt"); !ok || entry.Attempts != 2 {
+		t.Errorf("b.txt: got %+v, %v", entry, ok)
+	}
+	if _, ok := j.lookup("send/c.txt"); ok {
+		t.Error("c.txt: the truncated record must be skipped")
+	}
+	// Поврежденная строка не переносится в сжатый журнал
+	if lines := journalLines(t, dir); lines != 2 {
+		t.Errorf("journal has %d lines after compaction, want 2", lines)
+	}
+}
+
+func TestResumeArchivesAckedFile(t *testing.T) {
+	r, dir := newTestJournal(t)
+	filePath := filepath.Join(r.config().sendDir, "a.txt")
+	info := writeTestFile(t, filePath, "hello")
+
+	fileJournal.record(journalEntry{Path: filePath, State: stateInFlight, Size: info.Size(), ModTime: info.ModTime()})
+	fileJournal.record(journalEntry{Path: filePath, State: stateAcked, SHA256: "abc"})
+	reopenJournal(t, dir)
+	resumeFromJournal()
+
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatalf("acked file is still in the send directory: %v", err)
+	}
+	archived := filepath.Join(r.config().archiveDir, time.Now().Format("2006-01-02"), "a.txt")
+	if _, err := os.Stat(archived); err != nil {
+		t.Fatalf("acked file was not archived: %v", err)
+	}
+	if _, ok := fileJournal.lookup(filePath); ok {
+		t.Error("archived file must leave the journal")
+	}
+	r.mu.Lock()
+	_, tracked := r.firstSeen[filePath]
+	r.mu.Unlock()
+	if tracked {
+		t.Error("archived file must not be tracked for sending")
+	}
+}
+
+func TestResumeTreatsReplacedFileAsOutdated(t *testing.T) {
+	r, dir := newTestJournal(t)
+	filePath := filepath.Join(r.config().sendDir, "a.txt")
+	info := writeTestFile(t, filePath, "old")
+	fileJournal.record(journalEntry{Path: filePath, State: stateAcked, Size: info.Size(), ModTime: info.ModTime()})
+
+	// Новый файл с тем же именем не должен считаться доставленным
+	writeTestFile(t, filePath, "new content")
+	reopenJournal(t, dir)
+	resumeFromJournal()
+
+	if _, err := os.Stat(filePath); err != nil {
+		t.Fatalf("replaced file must stay in the send directory: %v", err)
+	}
+	if entries, _ := os.ReadDir(r.config().archiveDir); len(entries) != 0 {
+		t.Errorf("replaced file must not be archived, archive has %d entries", len(entries))
+	}
+	if _, ok := fileJournal.lookup(filePath); ok {
+		t.Error("outdated record must be dropped")
+	}
+}
+
+func TestJournalSameFile(t *testing.T) {
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	entry := journalEntry{Size: 10, ModTime: modTime}
+	path := filepath.Join(t.TempDir(), "f")
+	writeTestFile(t, path, "0123456789")
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path)
+	if !entry.sameFile(info) {
+		t.Error("same size and mtime must match")
+	}
+	if err := os.Chtimes(path, modTime, modTime.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	info, _ = os.Stat(path)
+	if entry.sameFile(info) {
+		t.Error("changed mtime must not match")
+	}
+	info = writeTestFile(t, path, "01234")
+	if entry.sameFile(info) {
+		t.Error("changed size must not match")
+	}
+}
+
+func TestJournalCompactionDropsFinishedFiles(t *testing.T) {
+	dir := t.TempDir()
+	j, err := openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.record(journalEntry{Path: "send/archived.txt", State: stateInFlight})
+	j.record(journalEntry{Path: "send/archived.txt", State: stateArchived, ArchivedTo: "archive/x"})
+	j.record(journalEntry{Path: "send/removed.txt", State: stateDetected})
+	j.record(journalEntry{Path: "send/removed.txt", State: stateRemoved})
+	j.record(journalEntry{Path: "send/failed.txt", State: stateFailed, Attempts: 1})
+	j.record(journalEntry{Path: "send/failed.txt", State: stateFailed, Attempts: 2})
+	j.close()
+
+	if lines := journalLines(t, dir); lines != 6 {
+		t.Fatalf("journal has %d lines before compaction, want 6", lines)
+	}
+
+	j, err = openJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+	if lines := journalLines(t, dir); lines != 1 {
+		t.Errorf("journal has %d lines after compaction, want 1", lines)
+	}
+	for _, path := range []string{"send/archived.txt", "send/removed.txt"} {
+		if _, ok := j.lookup(path); ok {
+			t.Errorf("%s must be dropped by compaction", path)
+		}
+	}
+	if entry, ok := j.lookup("send/failed.txt"); !ok || entry.Attempts != 2 {
+		t.Errorf("failed.txt: got %+v, %v", entry, ok)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Тело запроса читается порциями не больше throttleBurst байт, чтобы скорость
+// выравнивалась и при низких ограничениях
+const throttleBurst = 64 * 1024
+
+// totalBandwidth ограничивает суммарную скорость отправки всех направлений ([Limits] TotalBandwidth)
+var totalBandwidth = rate.NewLimiter(rate.Inf, throttleBurst)
+
+// newBandwidthLimiter создает ограничитель скорости, 0 - без ограничения
+func newBandwidthLimiter(bytesPerSecond int64) *rate.Limiter {
+	return rate.NewLimiter(bandwidthLimit(bytesPerSecond), throttleBurst)
+}
+
+func bandwidthLimit(bytesPerSecond int64) rate.Limit {
+	if bytesPerSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(bytesPerSecond)
+}
+
+// bandwidthValue - текущее ограничение в байтах в секунду, 0 - без ограничения
+func bandwidthValue(limiter *rate.Limiter) int64 {
+	if limiter.Limit() == rate.Inf {
+		return 0
+	}
+	return int64(limiter.Limit())
+}
+
+// throttledBody ограничивает скорость чтения тела запроса общим ограничителем
+// и ограничителем направления. Ограничения можно менять во время отправки
+type throttledBody struct {
+	io.ReadCloser
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(p) > throttleBurst {
+		p = p[:throttleBurst]
+	}
+	n, err := b.ReadCloser.Read(p)
+	for _, limiter := range b.limiters {
+		if n == 0 || limiter.Limit() == rate.Inf {
+			continue
+		}
+		if waitErr := limiter.WaitN(b.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// throttle оборачивает тело запроса, если для направления или всей программы задано ограничение
+func (r *route) throttle(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	if body == nil || (totalBandwidth.Limit() == rate.Inf && r.bandwidth.Limit() == rate.Inf) {
+		return body
+	}
+	return &throttledBody{ReadCloser: body, ctx: ctx, limiters: []*rate.Limiter{totalBandwidth, r.bandwidth}}
+}
+
+// concurrencyLimit ограничивает число одновременных запросов направления
+// независимо от числа обработчиков ([Limits] MaxConcurrent)
+type concurrencyLimit struct {
+	mu      sync.Mutex
+	limit   int // 0 - без ограничения
+	active  int
+	changed chan struct{} // закрывается, когда освобождается место или меняется ограничение
+}
+
+func newConcurrencyLimit(limit int) *concurrencyLimit {
+	return &concurrencyLimit{limit: limit, changed: make(chan struct{})}
+}
+
+// acquire ждет свободного места; ожидание прерывается при завершении работы
+func (l *concurrencyLimit) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.limit == 0 || l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *concurrencyLimit) release() {
+	l.mu.Lock()
+	l.active--
+	l.notifyLocked()
+	l.mu.Unlock()
+}
+
+// set меняет ограничение; уже начатые запросы не прерываются
+func (l *concurrencyLimit) set(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.notifyLocked()
+	l.mu.Unlock()
+}
+
+func (l *concurrencyLimit) get() (limit, active int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit, l.active
+}
+
+func (l *concurrencyLimit) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// applyLimits применяет ограничения из конфигурации при запуске и перечитывании
+func (r *route) applyLimits(cfg routeConfig) {
+	r.bandwidth.SetLimit(bandwidthLimit(cfg.bandwidth))
+	r.concurrency.set(cfg.maxConcurrent)
+}
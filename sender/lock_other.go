@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// tryLockFile - в Windows файл, открытый другим процессом без общего доступа на
+// запись, не откроется еще при вызове os.OpenFile, дополнительная проверка не нужна
+func tryLockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// tryLockFile захватывает и сразу отпускает эксклюзивную блокировку файла
+func tryLockFile(file *os.File) error {
+	fd := int(file.Fd())
+	if err := unix.Flock(fd, unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		return err
+	}
+	return unix.Flock(fd, unix.LOCK_UN)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// Метрики Prometheus с меткой направления route
+var (
+	metricFilesDetected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sender",
+		Name:      "files_detected_total",
+		Help:      "Files found in the send directory.",
+	}, []string{"route"})
+
+	metricFilesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sender",
+		Name:      "files_sent_total",
+		Help:      "Files delivered to the server.",
+	}, []string{"route"})
+
+	metricFilesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sender",
+		Name:      "files_failed_total",
+		Help:      "Files moved to the failed directory.",
+	}, []string{"route"})
+
+	metricUploadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sender",
+		Name:      "upload_errors_total",
+		Help:      "Failed upload attempts, including those that will be retried.",
+	}, []string{"route"})
+
+	metricBytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sender",
+		Name:      "bytes_sent_total",
+		Help:      "Size of files delivered to the server.",
+	}, []string{"route"})
+
+	metricUploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "sender",
+		Name:      "upload_duration_seconds",
+		Help:      "Time to upload a file, successful uploads only.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14), // 50ms .. ~7m
+	}, []string{"route"})
+
+	metricLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "sender",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last delivered file.",
+	}, []string{"route"})
+
+	descQueueDepth = prometheus.NewDesc("sender_queue_depth",
+		"Files waiting to be sent: not ready yet, waiting for a retry or for a free worker.",
+		[]string{"route"}, nil)
+
+	descInFlight = prometheus.NewDesc("sender_in_flight",
+		"Files currently being sent.",
+		[]string{"route"}, nil)
+)
+
+// routeCollector снимает размер очереди и число отправляемых файлов в момент запроса метрик
+type routeCollector struct{}
+
+func (routeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descQueueDepth
+	ch <- descInFlight
+}
+
+func (routeCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, r := range routes {
+		// Файлы в очереди обработчиков и в пакете закреплены, но еще не отправляются
+		waiting := len(r.waitingFiles())
+		r.mu.Lock()
+		inFlight := max(len(r.inFlight)-waiting, 0)
+		queued := len(r.firstSeen) - inFlight
+		r.mu.Unlock()
+
+		ch <- prometheus.MustNewConstMetric(descQueueDepth, prometheus.GaugeValue, float64(queued), r.name)
+		ch <- prometheus.MustNewConstMetric(descInFlight, prometheus.GaugeValue, float64(inFlight), r.name)
+	}
+}
+
+// startMetricsServer запускает HTTP-сервер метрик, если задан [Metrics] Listen
+func startMetricsServer(listen, path string) {
+	if listen == "" {
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		metricFilesDetected, metricFilesSent, metricFilesFailed, metricUploadErrors,
+		metricBytesSent, metricUploadDuration, metricLastSuccess,
+		routeCollector{},
+	)
+
+	// Счетчики направлений видны сразу, а не после первого события
+	for _, r := range routes {
+		for _, vec := range []*prometheus.CounterVec{metricFilesDetected, metricFilesSent, metricFilesFailed, metricUploadErrors, metricBytesSent} {
+			vec.WithLabelValues(r.name)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	go func() {
+		log.Info().Msg(fmt.Sprintf("Serving metrics on http://%s%s", listen, path))
+		server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		if err := server.ListenAndServe(); err != nil {
+			log.Error().Msg(fmt.Sprintf("error serving metrics: %v", err))
+		}
+	}()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Порядок файлов с одинаковым приоритетом ([Priority] Order)
+const (
+	orderFIFO     = "fifo"     // в порядке готовности
+	orderSmallest = "smallest" // сначала маленькие
+	orderLargest  = "largest"
+	orderOldest   = "oldest" // сначала с более ранним временем изменения
+)
+
+// priorityRule - правило вида "*.q:10", "urgent_*:20", "age>1h:5", "size>100MB:-5".
+// Приоритет файла - сумма весов подошедших правил
+type priorityRule struct {
+	pattern string        // шаблон имени файла
+	minAge  time.Duration // age>...
+	minSize int64         // size>...
+	maxSize int64         // size<...
+	weight  int
+}
+
+// priorityConfig - настройки очереди направления
+type priorityConfig struct {
+	rules    []priorityRule
+	order    string
+	high     int // файлы с приоритетом не ниже high считаются срочными
+	reserved int // обработчики, которые берут только срочные файлы
+}
+
+func parsePriorityRules(specs []string) ([]priorityRule, error) {
+	var rules []priorityRule
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("[Priority] Rules: %q must look like *.q:10, age>1h:5 or size<1MB:5", spec)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(spec[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("[Priority] Rules: %q: invalid weight", spec)
+		}
+		rule := priorityRule{weight: weight}
+
+		condition := strings.TrimSpace(spec[:i])
+		switch {
+		case strings.HasPrefix(condition, "age>"):
+			rule.minAge, err = time.ParseDuration(strings.TrimPrefix(condition, "age>"))
+		case strings.HasPrefix(condition, "size>"):
+			rule.minSize, err = parseSize(strings.TrimPrefix(condition, "size>"))
+		case strings.HasPrefix(condition, "size<"):
+			rule.maxSize, err = parseSize(strings.TrimPrefix(condition, "size<"))
+		default:
+			rule.pattern = condition
+			_, err = filepath.Match(condition, "")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[Priority] Rules: %q: %v", spec, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule priorityRule) matches(file *queuedFile, now time.Time) bool {
+	switch {
+	case rule.pattern != "":
+		matched, _ := filepath.Match(rule.pattern, filepath.Base(file.path))
+		return matched
+	case rule.minAge > 0:
+		return now.Sub(file.modTime) > rule.minAge
+	case rule.minSize > 0:
+		return file.size > rule.minSize
+	case rule.maxSize > 0:
+		return file.size < rule.maxSize
+	}
+	return false
+}
+
+// priority вычисляется при каждом выборе файла, поэтому правила по возрасту
+// и новые настройки после перечитывания действуют и на файлы в очереди
+func (p *priorityConfig) priority(file *queuedFile, now time.Time) int {
+	priority := 0
+	for _, rule := range p.rules {
+		if rule.matches(file, now) {
+			priority += rule.weight
+		}
+	}
+	return priority
+}
+
+// before сравнивает файлы с одинаковым приоритетом
+func (p *priorityConfig) before(a, b *queuedFile) bool {
+	switch p.order {
+	case orderSmallest:
+		if a.size != b.size {
+			return a.size < b.size
+		}
+	case orderLargest:
+		if a.size != b.size {
+			return a.size > b.size
+		}
+	case orderOldest:
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.Before(b.modTime)
+		}
+	}
+	return a.seq < b.seq
+}
+
+// queuedFile - готовый к отправке файл, ожидающий свободного обработчика
+type queuedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	seq     uint64
+	urgent  bool // взят обработчиком как срочный
+}
+
+// fileQueue - очередь готовых файлов направления. Обработчики берут файл с
+// наибольшим приоритетом; часть обработчиков может быть зарезервирована для срочных
+type fileQueue struct {
+	mu      sync.Mutex
+	files   map[string]*queuedFile
+	seq     uint64
+	regular int  // обработчики, занятые несрочными файлами
+	closed  bool // очередь закрыта при завершении работы
+	changed chan struct{}
+}
+
+func newFileQueue() *fileQueue {
+	return &fileQueue{files: make(map[string]*queuedFile), changed: make(chan struct{})}
+}
+
+// push добавляет файл в очередь. Возвращает false, если очередь уже закрыта
+func (q *fileQueue) push(filePath string, size int64, modTime time.Time) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	q.seq++
+	q.files[filePath] = &queuedFile{path: filePath, size: size, modTime: modTime, seq: q.seq}
+	q.notifyLocked()
+	return true
+}
+
+// take выбирает файл для обработчика. Если подходящего файла нет, возвращает канал,
+// который закроется при изменении очереди; ok == false - очередь закрыта
+func (q *fileQueue) take(cfg *routeSettings) (file *queuedFile, wait <-chan struct{}, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil, nil, false
+	}
+
+	now := time.Now()
+	p := &cfg.priority
+	best, bestPriority := (*queuedFile)(nil), 0
+	for _, f := range q.files {
+		priority := p.priority(f, now)
+		if best == nil || priority > bestPriority || (priority == bestPriority && p.before(f, best)) {
+			best, bestPriority = f, priority
+		}
+	}
+	if best == nil {
+		return nil, q.changed, true
+	}
+
+	// Несрочные файлы не занимают зарезервированные обработчики
+	best.urgent = p.reserved > 0 && bestPriority >= p.high
+	if !best.urgent && p.reserved > 0 && q.regular >= cfg.numWorkers-p.reserved {
+		return nil, q.changed, true
+	}
+	if !best.urgent {
+		q.regular++
+	}
+	delete(q.files, best.path)
+	return best, nil, true
+}
+
+// done вызывается обработчиком после отправки файла
+func (q *fileQueue) done(file *queuedFile) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !file.urgent {
+		q.regular--
+		q.notifyLocked()
+	}
+}
+
+// drain убирает из очереди все файлы и возвращает их пути. При close очередь
+// больше не принимает файлы, а ожидающие обработчики завершаются
+func (q *fileQueue) drain(close bool) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	paths := make([]string, 0, len(q.files))
+	for path := range q.files {
+		paths = append(paths, path)
+	}
+	q.files = make(map[string]*queuedFile)
+	if close {
+		q.closed = true
+	}
+	q.notifyLocked()
+	return paths
+}
+
+// wake будит ожидающие обработчики, например после изменения настроек
+func (q *fileQueue) wake() {
+	q.mu.Lock()
+	q.notifyLocked()
+	q.mu.Unlock()
+}
+
+// remove убирает файл из очереди. Возвращает false, если файла в очереди нет
+func (q *fileQueue) remove(filePath string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.files[filePath]; !ok {
+		return false
+	}
+	delete(q.files, filePath)
+	return true
+}
+
+// queued возвращает файлы в очереди
+func (q *fileQueue) queued() map[string]bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	paths := make(map[string]bool, len(q.files))
+	for path := range q.files {
+		paths[path] = true
+	}
+	return paths
+}
+
+func (q *fileQueue) notifyLocked() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// waitingFiles - закрепленные файлы, которые ждут обработчика в очереди или
+// отправки пакетом, но еще не отправляются
+func (r *route) waitingFiles() map[string]bool {
+	waiting := r.queue.queued()
+	for _, filePath := range r.bundle.pending() {
+		waiting[filePath] = true
+	}
+	return waiting
+}
+
+// unqueue убирает файл из очереди или пакета, закрепление остается за вызывающим
+func (r *route) unqueue(filePath string) bool {
+	return r.queue.remove(filePath) || r.bundle.remove(filePath)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePriorityRules(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    priorityRule
+		wantErr bool
+	}{
+		{spec: "*.q:10", want: priorityRule{pattern: "*.q", weight: 10}},
+		{spec: "urgent_*:20", want: priorityRule{pattern: "urgent_*", weight: 20}},
+		{spec: " *.log : -5 ", want: priorityRule{pattern: "*.log", weight: -5}},
+		{spec: "age>1h:5", want: priorityRule{minAge: time.Hour, weight: 5}},
+		{spec: "age>90s:1", want: priorityRule{minAge: 90 * time.Second, weight: 1}},
+		{spec: "size>100MB:-5", want: priorityRule{minSize: 100 << 20, weight: -5}},
+		{spec: "size<1KB:3", want: priorityRule{maxSize: 1 << 10, weight: 3}},
+		// Вес отделяется последним двоеточием
+		{spec: "a:b:1", want: priorityRule{pattern: "a:b", weight: 1}},
+		{spec: "*.q", wantErr: true},
+		{spec: ":10", wantErr: true},
+		{spec: "*.q:high", wantErr: true},
+		{spec: "*.q:", wantErr: true},
+		{spec: "[a-:1", wantErr: true},
+		{spec: "age>soon:1", wantErr: true},
+		{spec: "size>big:1", wantErr: true},
+		{spec: "size<-1MB:1", wantErr: true},
+	}
+	for _, tt := range tests {
+		rules, err := parsePriorityRules([]string{tt.spec})
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePriorityRules(%q): expected an error, got %+v", tt.spec, rules)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePriorityRules(%q): %v", tt.spec, err)
+			continue
+		}
+		if len(rules) != 1 || rules[0] != tt.want {
+			t.Errorf("parsePriorityRules(%q) = %+v, want %+v", tt.spec, rules, tt.want)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	rules, err := parsePriorityRules([]string{"*.q:10", "urgent_*:20", "age>1h:5", "size>1MB:-3", "size<1KB:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &priorityConfig{rules: rules}
+	now := time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		file queuedFile
+		want int
+	}{
+		{name: "no rules match", file: queuedFile{path: "/send/a.txt", size: 10 << 10, modTime: now}, want: 0},
+		{name: "pattern on base name", file: queuedFile{path: "/send/urgent_dir/a.txt", size: 10 << 10, modTime: now}, want: 0},
+		{name: "weights add up", file: queuedFile{path: "/send/urgent_1.q", size: 10 << 10, modTime: now}, want: 30},
+		{name: "old file", file: queuedFile{path: "/send/a.txt", size: 10 << 10, modTime: now.Add(-2 * time.Hour)}, want: 5},
+		{name: "exactly one hour old", file: queuedFile{path: "/send/a.txt", size: 10 << 10, modTime: now.Add(-time.Hour)}, want: 0},
+		{name: "large file", file: queuedFile{path: "/send/a.q", size: 2 << 20, modTime: now}, want: 7},
+		{name: "small file", file: queuedFile{path: "/send/a.txt", size: 100, modTime: now}, want: 2},
+	}
+	for _, tt := range tests {
+		if got := p.priority(&tt.file, now); got != tt.want {
+			t.Errorf("%s: priority = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
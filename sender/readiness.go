@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Способы определения готовности файла к отправке
+const (
+	readyAge       = "age"       // прошло MinFileAge с момента обнаружения
+	readyStable    = "stable"    // размер и время изменения не менялись StableScans проверок подряд
+	readyExclusive = "exclusive" // файл можно открыть эксклюзивно и он не менялся StableScans проверок
+	readyMarker    = "marker"    // рядом появился файл-маркер, например file.txt.done
+)
+
+// readinessConfig - настройки готовности файлов для каталога отправки
+type readinessConfig struct {
+	strategy       string
+	minAge         time.Duration
+	stableScans    int
+	markerSuffixes []string
+	tempSuffixes   []string
+}
+
+// observation - последний замеченный размер и время изменения файла
+type observation struct {
+	size        int64
+	modTime     time.Time
+	stableCount int
+}
+
+// splitList разбирает список значений через запятую
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func hasAnySuffix(name string, suffixes []string) bool {
+	lower := strings.ToLower(name)
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(lower, strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isIgnored - временные файлы и файлы-маркеры никогда не отправляются
+func (rc readinessConfig) isIgnored(name string) bool {
+	if hasAnySuffix(name, rc.tempSuffixes) {
+		return true
+	}
+	return rc.strategy == readyMarker && hasAnySuffix(name, rc.markerSuffixes)
+}
+
+// isFileReady проверяет, закончена ли запись файла, выбранным в config.ini способом
+func isFileReady(r *route, filePath string, info os.FileInfo) bool {
+	r.mu.Lock()
+	firstSeen, exists := r.firstSeen[filePath]
+	stable := r.observeFileLocked(filePath, info)
+	r.mu.Unlock()
+
+	if !exists || time.Since(firstSeen) < r.config().readiness.minAge {
+		return false
+	}
+
+	switch r.config().readiness.strategy {
+	case readyStable:
+		return stable >= r.config().readiness.stableScans
+	case readyExclusive:
+		// Блокировка flock рекомендательная: cp, rsync и Samba ее не берут, поэтому
+		// файл должен еще и не меняться, как при stable
+		return stable >= r.config().readiness.stableScans && probeExclusive(filePath)
+	case readyMarker:
+		return r.config().readiness.markerPath(filePath) != ""
+	default:
+		return true
+	}
+}
+
+// observeFileLocked возвращает, сколько проверок подряд файл не менялся.
+// Вызывается под r.mu
+func (r *route) observeFileLocked(filePath string, info os.FileInfo) int {
+	obs, exists := r.observations[filePath]
+	if !exists {
+		r.observations[filePath] = &observation{size: info.Size(), modTime: info.ModTime()}
+		return 0
+	}
+
+	if obs.size == info.Size() && obs.modTime.Equal(info.ModTime()) {
+		obs.stableCount++
+	} else {
+		obs.size = info.Size()
+		obs.modTime = info.ModTime()
+		obs.stableCount = 0
+	}
+	return obs.stableCount
+}
+
+// probeExclusive пытается открыть файл на запись и захватить блокировку
+func probeExclusive(filePath string) bool {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if os.IsPermission(err) {
+		file, err = os.Open(filePath)
+	}
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	return tryLockFile(file) == nil
+}
+
+// markerPath ищет файл-маркер вида file.txt.done или file.done
+func (rc readinessConfig) markerPath(filePath string) string {
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	for _, suffix := range rc.markerSuffixes {
+		for _, candidate := range []string{filePath + suffix, base + suffix} {
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate
+			}
+		}
+	}
+	return ""
+}
+
+// removeMarkers удаляет файлы-маркеры после отправки файла
+func (rc readinessConfig) removeMarkers(filePath string) {
+	if rc.strategy != readyMarker {
+		return
+	}
+	for marker := rc.markerPath(filePath); marker != ""; marker = rc.markerPath(filePath) {
+		if err := os.Remove(marker); err != nil {
+			log.Error().Msg(fmt.Sprintf("error removing marker file: %s", err))
+			return
+		}
+	}
+}
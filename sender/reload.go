@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// Редактор может сохранять файл в несколько приемов, поэтому перечитываем его
+// после паузы в событиях
+const configReloadDelay = 500 * time.Millisecond
+
+// startConfigReload перечитывает файл конфигурации по сигналу SIGHUP и, если включено
+// WatchConfig, при изменении файла. Перечитывания выполняются по очереди
+func startConfigReload(watch bool) {
+	requests := make(chan struct{}, 1)
+	request := func() {
+		select {
+		case requests <- struct{}{}:
+		default:
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info().Msg("SIGHUP received, reloading configuration")
+			request()
+		}
+	}()
+
+	if watch {
+		go func() {
+			if err := watchConfigFile(request); err != nil {
+				log.Error().Msg(fmt.Sprintf("error watching %s for changes: %v", configSrc.path, err))
+			}
+		}()
+	}
+
+	go func() {
+		for range requests {
+			reloadConfig()
+		}
+	}()
+}
+
+// watchConfigFile следит за каталогом с config.ini: редакторы часто заменяют
+// файл новым, и подписка на сам файл после этого теряется
+func watchConfigFile(request func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	path, err := filepath.Abs(configSrc.path)
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+	log.Info().Msg(fmt.Sprintf("Watching %s for changes", path))
+
+	delay := time.NewTimer(0)
+	<-delay.C
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) == path && event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				delay.Reset(configReloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Error().Msg(fmt.Sprintf("config watcher error: %v", err))
+		case <-delay.C:
+			log.Info().Msg(fmt.Sprintf("%s changed, reloading configuration", configSrc.path))
+			request()
+		}
+	}
+}
+
+// reloadConfig проверяет новую конфигурацию и применяет ее к работающим
+// направлениям. Если конфигурация некорректна, продолжают действовать прежние настройки
+func reloadConfig() {
+	conf, _, err := loadConfig(configSrc)
+	if err == nil {
+		err = checkReloadable(conf.routes)
+	}
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("error in the %s file, keeping the current configuration: %s", configSrc.path, err))
+		return
+	}
+
+	totalBandwidth.SetLimit(bandwidthLimit(conf.totalBandwidth))
+
+	if conf.logDir != logDir || conf.logFile != logFile {
+		log.Info().Msg("LogDir and LogFile changes take effect after restart")
+	}
+
+	// Набор направлений и их порядок проверены в checkReloadable
+	for i, rc := range conf.routes {
+		r := routes[i]
+		dirs := []string{rc.archiveDir, rc.failedDir}
+		if rc.usesStaging() {
+			dirs = append(dirs, rc.stagingDir)
+		}
+		for _, dir := range dirs {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				log.Error().Msg(fmt.Sprintf("error creating directory %s: %v", dir, err))
+			}
+		}
+
+		// Запросы, уже начатые обработчиками, завершаются со старыми настройками.
+		// Свободные соединения прежнего клиента закрываются сразу, соединения
+		// начатых запросов - по IdleConnTimeout после их завершения
+		old := r.settings.Swap(newRouteSettings(rc))
+		old.client.CloseIdleConnections()
+		r.resizeWorkers(rc.numWorkers)
+		r.applyLimits(rc)
+		r.bundleUnsupported.Store(false)
+		r.queue.wake()
+
+		log.Info().Msg(fmt.Sprintf("Route %s: %s -> %s, %d chanals", r.name, rc.sendDir, rc.serverAddr, rc.numWorkers))
+	}
+
+	log.Info().Msg("Configuration reloaded")
+}
+
+// checkReloadable - добавление и удаление направлений, а также смена каталога
+// отправки и способа наблюдения за ним требуют перезапуска программы
+func checkReloadable(configs []routeConfig) error {
+	if len(configs) != len(routes) {
+		return fmt.Errorf("the list of routes has changed, restart the program to apply it")
+	}
+	for i, rc := range configs {
+		current := routes[i].config()
+		if rc.name != current.name {
+			return fmt.Errorf("the list of routes has changed, restart the program to apply it")
+		}
+		if rc.sendDir != current.sendDir || rc.recursive != current.recursive || rc.watchMode != current.watchMode {
+			return fmt.Errorf("route %s: SendDir, Recursive and WatchMode changes require a restart", rc.name)
+		}
+	}
+	return nil
+}
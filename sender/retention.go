@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Временные файлы сжатия, оставшиеся после аварийного завершения, удаляются при следующей проверке
+const retentionTempPattern = "*.tar.gz.tmp-*"
+
+// retentionConfig - хранение архива ([Archive]). 0 - ограничение не действует
+type retentionConfig struct {
+	keepRawDays     int   // дни старше сжимаются в YYYY-MM-DD.tar.gz
+	deleteAfterDays int   // дни старше удаляются
+	maxTotalSize    int64 // при превышении удаляются самые старые дни
+	dryRun          bool  // только записать в лог, что было бы сделано
+	checkInterval   time.Duration
+}
+
+func (c retentionConfig) enabled() bool {
+	return c.keepRawDays > 0 || c.deleteAfterDays > 0 || c.maxTotalSize > 0
+}
+
+// Направления могут использовать один ArchiveDir, проверки выполняются по очереди
+var retentionMu sync.Mutex
+
+// archiveDay - папка дня в архиве или ее сжатая копия
+type archiveDay struct {
+	path       string
+	date       time.Time
+	age        int // дней назад, сегодня - 0
+	compressed bool
+	size       int64
+}
+
+// runJanitor периодически применяет правила хранения к архиву направления.
+// Настройки читаются при каждой проверке, поэтому перечитывание действует сразу
+func runJanitor(r *route) {
+	// Первая проверка - через минуту после запуска, чтобы не замедлять старт
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stopping.Done():
+			return
+		case <-timer.C:
+		}
+		cfg := r.config()
+		if cfg.retention.enabled() {
+			applyRetention(r.name, cfg.archiveDir, cfg.retention)
+		}
+		timer.Reset(r.config().retention.checkInterval)
+	}
+}
+
+func applyRetention(routeName, archiveDir string, c retentionConfig) {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	prefix := fmt.Sprintf("Route %s: archive retention: ", routeName)
+	if c.dryRun {
+		prefix = fmt.Sprintf("Route %s: archive retention (dry run): ", routeName)
+	}
+
+	if !c.dryRun {
+		leftovers, _ := filepath.Glob(filepath.Join(archiveDir, retentionTempPattern))
+		for _, path := range leftovers {
+			_ = os.Remove(path)
+		}
+	}
+
+	days, otherSize, err := listArchiveDays(archiveDir)
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("%serror reading %s: %v", prefix, archiveDir, err))
+		return
+	}
+
+	var kept []archiveDay
+	for _, day := range days {
+		switch {
+		case day.age == 0:
+			// Сегодняшняя папка еще пополняется
+		case c.deleteAfterDays > 0 && day.age >= c.deleteAfterDays:
+			if removeArchiveDay(prefix, day, c.dryRun, fmt.Sprintf("older than %d days", c.deleteAfterDays)) {
+				continue
+			}
+		case c.keepRawDays > 0 && day.age >= c.keepRawDays && !day.compressed:
+			if c.dryRun {
+				log.Info().Msg(fmt.Sprintf("%swould compress %s (%d bytes)", prefix, day.path, day.size))
+				break
+			}
+			if compressed, err := compressArchiveDay(day); err != nil {
+				log.Error().Msg(fmt.Sprintf("%serror compressing %s: %v", prefix, day.path, err))
+			} else {
+				log.Info().Msg(fmt.Sprintf("%scompressed %s to %s (%d -> %d bytes)", prefix, day.path, compressed.path, day.size, compressed.size))
+				day = compressed
+			}
+		}
+		kept = append(kept, day)
+	}
+
+	if c.maxTotalSize <= 0 {
+		return
+	}
+	total := otherSize
+	for _, day := range kept {
+		total += day.size
+	}
+	// Дни отсортированы от старых к новым, сегодняшний не удаляется
+	for _, day := range kept {
+		if total <= c.maxTotalSize || day.age == 0 {
+			break
+		}
+		if removeArchiveDay(prefix, day, c.dryRun, fmt.Sprintf("archive exceeds MaxTotalSize (%d bytes)", total)) {
+			total -= day.size
+		}
+	}
+	if total > c.maxTotalSize {
+		log.Info().Msg(fmt.Sprintf("%s%s still takes %d bytes, more than MaxTotalSize %d", prefix, archiveDir, total, c.maxTotalSize))
+	}
+}
+
+// listArchiveDays возвращает дни архива от старых к новым и размер остальных файлов
+func listArchiveDays(archiveDir string) ([]archiveDay, int64, error) {
+	entries, err := os.ReadDir(archiveDir)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+	var days []archiveDay
+	var otherSize int64
+	for _, entry := range entries {
+		path := filepath.Join(archiveDir, entry.Name())
+		size := pathSize(path)
+
+		// YYYY-MM-DD, YYYY-MM-DD.tar.gz или YYYY-MM-DD.N.tar.gz, если день сжат повторно
+		date, err := time.ParseInLocation("2006-01-02", strings.SplitN(entry.Name(), ".", 2)[0], time.Local)
+		compressed := strings.HasSuffix(entry.Name(), ".tar.gz") && !entry.IsDir()
+		if err != nil || (!entry.IsDir() && !compressed) {
+			otherSize += size
+			continue
+		}
+		age := int(today.Sub(date).Round(24*time.Hour) / (24 * time.Hour))
+		if age < 0 {
+			age = 0
+		}
+		days = append(days, archiveDay{path: path, date: date, age: age, compressed: compressed, size: size})
+	}
+	sort.SliceStable(days, func(i, j int) bool { return days[i].date.Before(days[j].date) })
+	return days, otherSize, nil
+}
+
+// pathSize - размер файла или всех файлов каталога
+func pathSize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// removeArchiveDay удаляет день архива; в режиме DryRun только записывает в лог
+func removeArchiveDay(prefix string, day archiveDay, dryRun bool, reason string) bool {
+	if dryRun {
+		log.Info().Msg(fmt.Sprintf("%swould delete %s (%d bytes): %s", prefix, day.path, day.size, reason))
+		return true
+	}
+	if err := os.RemoveAll(day.path); err != nil {
+		log.Error().Msg(fmt.Sprintf("%serror deleting %s: %v", prefix, day.path, err))
+		return false
+	}
+	log.Info().Msg(fmt.Sprintf("%sdeleted %s (%d bytes): %s", prefix, day.path, day.size, reason))
+	return true
+}
+
+// compressArchiveDay упаковывает папку дня в tar.gz рядом с ней и удаляет папку.
+// Пути в архиве начинаются с имени папки, поэтому распаковка восстанавливает ее
+// вместе с manifest.jsonl
+func compressArchiveDay(day archiveDay) (archiveDay, error) {
+	archiveDir, name := filepath.Split(day.path)
+	target := filepath.Join(archiveDir, name+".tar.gz")
+	for n := 1; ; n++ {
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			break
+		}
+		target = filepath.Join(archiveDir, fmt.Sprintf("%s.%d.tar.gz", name, n))
+	}
+
+	out, err := os.CreateTemp(archiveDir, filepath.Base(target)+".tmp-*")
+	if err != nil {
+		return day, err
+	}
+	err = writeDayArchive(out, day.path)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), target)
+	}
+	if err != nil {
+		_ = os.Remove(out.Name())
+		return day, err
+	}
+	if err := os.RemoveAll(day.path); err != nil {
+		return day, fmt.Errorf("compressed to %s, but the folder was not removed: %v", target, err)
+	}
+
+	day.path, day.compressed, day.size = target, true, pathSize(target)
+	return day, nil
+}
+
+func writeDayArchive(w io.Writer, dayDir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	base := filepath.Dir(dayDir)
+
+	err := filepath.WalkDir(dayDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Сжатие прерывается при завершении работы и повторяется после запуска
+		if stopping.Err() != nil {
+			return stopping.Err()
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.CopyN(tw, file, header.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
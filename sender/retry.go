@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// retryPolicy - параметры повторных попыток отправки
+type retryPolicy struct {
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+	jitter      float64
+}
+
+// retryState - состояние повторных попыток для одного файла
+type retryState struct {
+	attempts     int
+	authFailures int // отказы в авторизации подряд, не расходуют попытки
+	nextAttempt  time.Time
+	lastError    string
+}
+
+// backoff вычисляет задержку перед попыткой с номером attempt+1
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := p.baseBackoff
+	for i := 1; i < attempt && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+
+	if p.jitter > 0 {
+		delta := float64(delay) * p.jitter
+		delay += time.Duration(delta * (2*rand.Float64() - 1))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// sendError - ошибка отправки файла с информацией об ответе сервера
+type sendError struct {
+	StatusCode int
+	Response   string
+	Err        error
+	Retryable  bool
+	Auth       bool // 401 или 403: ошибка настроек [Auth], а не файла
+}
+
+func (e *sendError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("error receiving response from server: %d %s - %s", e.StatusCode, http.StatusText(e.StatusCode), e.Response)
+	}
+	return fmt.Sprintf("error sending the request: %v", e.Err)
+}
+
+func (e *sendError) Unwrap() error {
+	return e.Err
+}
+
+// newResponseError классифицирует ответ сервера: 5xx, 408 и 429 можно повторить,
+// 401 и 403 повторяются без ограничения числа попыток, остальные ошибки 4xx
+// считаются постоянными
+func newResponseError(statusCode int, body []byte) *sendError {
+	auth := isAuthStatus(statusCode)
+	retryable := statusCode >= 500 ||
+		statusCode == http.StatusRequestTimeout ||
+		statusCode == http.StatusTooManyRequests ||
+		auth ||
+		isChecksumMismatch(statusCode, body)
+	return &sendError{StatusCode: statusCode, Response: string(body), Retryable: retryable, Auth: auth}
+}
+
+func isAuthStatus(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// isAuthFailure - сервер отклонил авторизацию направления
+func isAuthFailure(err error) bool {
+	var sendErr *sendError
+	return errors.As(err, &sendErr) && sendErr.Auth
+}
+
+// newNetworkError - сетевые ошибки всегда можно повторить
+func newNetworkError(err error) *sendError {
+	return &sendError{Err: err, Retryable: true}
+}
+
+// isRetryable - локальные ошибки (например, файл занят) тоже считаются временными
+func isRetryable(err error) bool {
+	var sendErr *sendError
+	if errors.As(err, &sendErr) {
+		return sendErr.Retryable
+	}
+	return true
+}
+
+// retryDue проверяет, наступило ли время следующей попытки отправки файла
+func (r *route) retryDue(filePath string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, exists := r.retries[filePath]
+	return !exists || !time.Now().Before(state.nextAttempt)
+}
+
+// restoreRetry восстанавливает счетчик попыток из журнала
+func (r *route) restoreRetry(entry journalEntry) {
+	r.mu.Lock()
+	r.retries[entry.Path] = &retryState{
+		attempts:    entry.Attempts,
+		nextAttempt: entry.Time.Add(r.config().retry.backoff(entry.Attempts)),
+		lastError:   entry.Error,
+	}
+	r.mu.Unlock()
+}
+
+// handleSendFailure планирует повторную отправку файла или переносит его в FailedDir
+func handleSendFailure(r *route, filePath string, sendErr error) {
+	r.mu.Lock()
+	state, exists := r.retries[filePath]
+	if !exists {
+		state = &retryState{}
+		r.retries[filePath] = state
+	}
+	auth := isAuthFailure(sendErr)
+	if auth {
+		state.authFailures++
+	} else {
+		state.attempts++
+		state.authFailures = 0
+	}
+	state.lastError = sendErr.Error()
+	attempts, authFailures := state.attempts, state.authFailures
+	r.mu.Unlock()
+
+	fileJournal.record(journalEntry{Path: filePath, State: stateFailed, Attempts: attempts, Error: sendErr.Error()})
+	metricUploadErrors.WithLabelValues(r.name).Inc()
+
+	policy := r.config().retry
+	// Файл не виноват в неверных настройках авторизации: он не переносится в
+	// FailedDir, а отправка повторяется с увеличивающейся задержкой
+	if auth {
+		delay := policy.backoff(authFailures)
+		r.mu.Lock()
+		state.nextAttempt = time.Now().Add(delay)
+		r.mu.Unlock()
+
+		log.Error().Msg(fmt.Sprintf("Route %s: the server rejected authorization, check [Auth] (%s). The file %s will be sent again in %s", r.name, sendErr, filePath, delay.Round(time.Millisecond)))
+		r.releaseFile(filePath)
+		return
+	}
+	if isRetryable(sendErr) && attempts < policy.maxAttempts {
+		delay := policy.backoff(attempts)
+		r.mu.Lock()
+		state.nextAttempt = time.Now().Add(delay)
+		r.mu.Unlock()
+
+		log.Info().Msg(fmt.Sprintf("The file %s will be sent again in %s (attempt %d of %d)", filePath, delay.Round(time.Millisecond), attempts+1, policy.maxAttempts))
+		r.releaseFile(filePath)
+		return
+	}
+
+	if isRetryable(sendErr) {
+		log.Error().Msg(fmt.Sprintf("The file %s could not be sent after %d attempts", filePath, attempts))
+	} else {
+		log.Error().Msg(fmt.Sprintf("The file %s was rejected by the server: %s", filePath, sendErr))
+	}
+
+	// Файл остается закрепленным, пока не исчезнет из каталога отправки
+	if err := moveToFailed(r, filePath, sendErr, attempts); err != nil {
+		log.Error().Msg(fmt.Sprintf("error moving file to failed directory: %s", err))
+		r.releaseFile(filePath)
+	}
+}
+
+// failureReport - содержимое файла .error.json рядом с неотправленным файлом
+type failureReport struct {
+	File       string    `json:"file"`
+	FailedAt   time.Time `json:"failed_at"`
+	Attempts   int       `json:"attempts"`
+	Retryable  bool      `json:"retryable"`
+	Error      string    `json:"error"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Response   string    `json:"response,omitempty"`
+}
+
+// moveToFailed перемещает файл в FailedDir и сохраняет описание последней ошибки
+func moveToFailed(r *route, filePath string, sendErr error, attempts int) error {
+	destDir := filepath.Join(r.config().failedDir, filepath.Dir(r.relativePath(filePath)))
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+
+	destPath := uniqueDestPath(destDir, filepath.Base(filePath))
+	r.removeStaged(filePath)
+	if err := os.Rename(filePath, destPath); err != nil {
+		return fmt.Errorf("error moving file: %v", err)
+	}
+
+	report := failureReport{
+		File:      filepath.Base(filePath),
+		FailedAt:  time.Now(),
+		Attempts:  attempts,
+		Retryable: isRetryable(sendErr),
+		Error:     sendErr.Error(),
+	}
+	var respErr *sendError
+	if errors.As(sendErr, &respErr) {
+		report.StatusCode = respErr.StatusCode
+		report.Response = respErr.Response
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding error report: %v", err)
+	}
+	if err := os.WriteFile(destPath+".error.json", data, 0644); err != nil {
+		return fmt.Errorf("error writing error report: %v", err)
+	}
+
+	metricFilesFailed.WithLabelValues(r.name).Inc()
+	log.Info().Msg(fmt.Sprintf("File moved to failed directory: %s", destPath))
+	return nil
+}
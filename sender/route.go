@@ -0,0 +1,463 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"filippo.io/age"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+	"gopkg.in/ini.v1"
+)
+
+// Префикс секций config.ini, описывающих направления передачи: [Route.<name>]
+const routeSectionPrefix = "Route."
+
+// routeConfig - настройки одного направления передачи файлов
+type routeConfig struct {
+	name string
+
+	serverAddr string
+	authMode   string
+	username   string
+	password   string
+	token      string
+	loginURL   string
+	useHTTPS   bool
+	tlsConfig  *tls.Config
+
+	sendDir    string
+	archiveDir string
+	failedDir  string
+	numWorkers int
+
+	recursive      bool
+	filter         fileFilter
+	readiness      readinessConfig
+	watchMode      string
+	pollInterval   time.Duration
+	rescanInterval time.Duration
+
+	chunkSize       int64
+	chunkThreshold  int64
+	compression     string
+	skipCompression []string
+
+	// Файлы шифруются для recipients во временную копию в stagingDir
+	recipients []age.Recipient
+	stagingDir string
+
+	// Ограничения скорости (байт в секунду) и числа одновременных запросов, 0 - без ограничения
+	bandwidth     int64
+	maxConcurrent int
+
+	schedule schedule
+	priority priorityConfig
+	bundle   bundleConfig
+
+	retention retentionConfig
+
+	retry retryPolicy
+}
+
+// routeStats - статистика отправки по направлению
+type routeStats struct {
+	mu        sync.Mutex
+	filesSent int
+	bytesSent int64
+	lastName  string
+	lastTime  time.Time
+}
+
+// routeSettings - действующие настройки направления вместе с HTTP-клиентом и
+// авторизацией. При перечитывании config.ini набор заменяется целиком, поэтому
+// обработчик всегда видит согласованные значения
+type routeSettings struct {
+	routeConfig
+
+	client *http.Client
+	auth   *authenticator
+}
+
+func newRouteSettings(cfg routeConfig) *routeSettings {
+	return &routeSettings{
+		routeConfig: cfg,
+		client:      newHTTPClient(cfg.tlsConfig),
+		auth: &authenticator{
+			mode:     cfg.authMode,
+			username: cfg.username,
+			password: cfg.password,
+			token:    cfg.token,
+			loginURL: cfg.loginURL,
+		},
+	}
+}
+
+// route - направление передачи: каталог отправки, сервер, пул обработчиков и
+// состояние отслеживаемых файлов
+type route struct {
+	name     string
+	settings atomic.Pointer[routeSettings]
+
+	queue  *fileQueue  // готовые файлы в порядке приоритета
+	bundle *bundler    // мелкие файлы, ожидающие отправки пакетом
+	paused atomic.Bool // отправка приостановлена через API управления
+
+	// Сервер не принимает пакеты, файлы отправляются по одному до перечитывания настроек
+	bundleUnsupported atomic.Bool
+
+	// Пул обработчиков, размер меняется при перечитывании настроек
+	workersMu  sync.Mutex
+	workers    int
+	stopWorker chan struct{}
+	workerWG   sync.WaitGroup
+
+	// Ограничения меняются при перечитывании настроек и через API управления
+	bandwidth   *rate.Limiter
+	concurrency *concurrencyLimit
+
+	mu           sync.Mutex
+	firstSeen    map[string]time.Time
+	inFlight     map[string]bool // Файлы, переданные обработчикам
+	retries      map[string]*retryState
+	observations map[string]*observation
+	ignored      map[string]bool // Исключенные фильтрами файлы, о которых уже записано в лог
+	pushed       map[string]bool // Файлы, отправляемые вне расписания, см. POST /push
+
+	stats routeStats
+}
+
+var routes []*route
+
+func newRoute(cfg routeConfig) *route {
+	r := &route{
+		name:         cfg.name,
+		queue:        newFileQueue(),
+		bundle:       newBundler(),
+		stopWorker:   make(chan struct{}),
+		firstSeen:    make(map[string]time.Time),
+		inFlight:     make(map[string]bool),
+		retries:      make(map[string]*retryState),
+		observations: make(map[string]*observation),
+		ignored:      make(map[string]bool),
+		pushed:       make(map[string]bool),
+		bandwidth:    newBandwidthLimiter(cfg.bandwidth),
+		concurrency:  newConcurrencyLimit(cfg.maxConcurrent),
+	}
+	r.settings.Store(newRouteSettings(cfg))
+	return r
+}
+
+// config возвращает текущие настройки направления
+func (r *route) config() *routeSettings {
+	return r.settings.Load()
+}
+
+// resizeWorkers запускает или останавливает обработчики, пока их не станет n.
+// Занятый обработчик завершается после отправки текущего файла
+func (r *route) resizeWorkers(n int) {
+	r.workersMu.Lock()
+	defer r.workersMu.Unlock()
+
+	for ; r.workers < n; r.workers++ {
+		r.workerWG.Add(1)
+		go func() {
+			defer r.workerWG.Done()
+			sendFileWorker(r)
+		}()
+	}
+	for ; r.workers > n; r.workers-- {
+		go func() { r.stopWorker <- struct{}{} }()
+	}
+}
+
+// routeForPath находит направление, к каталогу отправки которого относится файл
+func routeForPath(filePath string) *route {
+	var found *route
+	for _, r := range routes {
+		dir := filepath.Clean(r.config().sendDir)
+		if strings.HasPrefix(filepath.Clean(filePath), dir+string(filepath.Separator)) {
+			if found == nil || len(dir) > len(filepath.Clean(found.config().sendDir)) {
+				found = r
+			}
+		}
+	}
+	return found
+}
+
+// relativePath возвращает путь файла относительно каталога отправки
+func (r *route) relativePath(filePath string) string {
+	rel, err := filepath.Rel(r.config().sendDir, filePath)
+	if err != nil {
+		return filepath.Base(filePath)
+	}
+	return rel
+}
+
+// watches проверяет, относится ли файл к каталогу отправки направления:
+// вложенные каталоги учитываются только в рекурсивном режиме
+func (r *route) watches(filePath string) bool {
+	rel := r.relativePath(filePath)
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	return r.config().recursive || !strings.ContainsRune(rel, filepath.Separator)
+}
+
+// isServiceDir - каталоги архива, неотправленных и исключенных файлов могут
+// находиться внутри каталога отправки, их содержимое не отправляется
+func (r *route) isServiceDir(dir string) bool {
+	cfg := r.config()
+	for _, serviceDir := range []string{cfg.archiveDir, cfg.failedDir, cfg.stagingDir, cfg.filter.ignoredDir} {
+		if serviceDir != "" && filepath.Clean(serviceDir) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeKeys - значение ключа берется из секции направления, а если его там нет,
+// то из общей секции config.ini ([Server], [Auth], [Directories] и т.д.)
+type routeKeys struct {
+	cfg     *ini.File
+	section *ini.Section
+}
+
+func (k routeKeys) key(fallbackSection, name string) *ini.Key {
+	if k.section != nil && k.section.HasKey(name) {
+		return k.section.Key(name)
+	}
+	return k.cfg.Section(fallbackSection).Key(name)
+}
+
+// loadRoutes читает секции [Route.<name>]. Если их нет, используется одно
+// направление "default", собранное из общих секций
+func loadRoutes(cfg *ini.File) ([]routeConfig, error) {
+	var configs []routeConfig
+
+	for _, section := range cfg.Sections() {
+		if !strings.HasPrefix(section.Name(), routeSectionPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(section.Name(), routeSectionPrefix)
+		if name == "" {
+			return nil, fmt.Errorf("route section [%s] has no name", section.Name())
+		}
+		if !section.HasKey("SendDir") {
+			return nil, fmt.Errorf("route %s: SendDir is required", name)
+		}
+		rc, err := loadRouteConfig(name, routeKeys{cfg: cfg, section: section})
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %v", name, err)
+		}
+		configs = append(configs, rc)
+	}
+
+	if len(configs) == 0 {
+		rc, err := loadRouteConfig("default", routeKeys{cfg: cfg})
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, rc)
+	}
+
+	sort.Slice(configs, func(i, j int) bool { return configs[i].name < configs[j].name })
+
+	// Два направления не могут следить за одним каталогом
+	seen := make(map[string]string)
+	for _, rc := range configs {
+		dir, err := filepath.Abs(rc.sendDir)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: invalid SendDir: %v", rc.name, err)
+		}
+		if other, ok := seen[dir]; ok {
+			return nil, fmt.Errorf("routes %s and %s use the same SendDir %s", other, rc.name, rc.sendDir)
+		}
+		seen[dir] = rc.name
+
+		if rc.numWorkers < 1 {
+			return nil, fmt.Errorf("route %s: numWorkers must be at least 1", rc.name)
+		}
+	}
+
+	return configs, nil
+}
+
+func loadRouteConfig(name string, k routeKeys) (routeConfig, error) {
+	rc := routeConfig{name: name}
+
+	rc.useHTTPS = k.key("Server", "UseHTTPS").MustBool()
+	protocol := "http"
+	if rc.useHTTPS {
+		protocol = "https"
+		var err error
+		rc.tlsConfig, err = newTLSConfig(tlsSettings{
+			certFile:   k.key("Server", "CertFile").String(),
+			keyFile:    k.key("Server", "KeyFile").String(),
+			caFile:     k.key("Server", "CAFile").String(),
+			pins:       splitList(k.key("Server", "ServerPins").String()),
+			minVersion: k.key("Server", "MinTLSVersion").String(),
+		})
+		if err != nil {
+			return rc, err
+		}
+	}
+
+	baseURL := fmt.Sprintf("%s://%s:%s",
+		protocol,
+		k.key("Server", "Host").String(),
+		k.key("Server", "Port").String())
+	rc.serverAddr = fmt.Sprintf("%s/%s", baseURL, k.key("Server", "Context").String())
+
+	rc.authMode = k.key("Auth", "Mode").String()
+	rc.username = k.key("Auth", "Username").String()
+	rc.password = k.key("Auth", "Password").String()
+	rc.token = k.key("Auth", "Token").String()
+	rc.loginURL = k.key("Auth", "LoginURL").String()
+	if rc.loginURL == "" {
+		rc.loginURL = baseURL + "/login"
+	}
+	if rc.authMode == authBearer && rc.token == "" {
+		return rc, fmt.Errorf("[Auth] Token is required for Mode = %s", authBearer)
+	}
+
+	rc.sendDir = k.key("Directories", "SendDir").String()
+	rc.archiveDir = k.key("Directories", "ArchiveDir").String()
+	rc.failedDir = k.key("Directories", "FailedDir").String()
+
+	// По умолчанию у каждого направления свой подкаталог архива и неотправленных файлов
+	if k.section != nil {
+		if !k.section.HasKey("ArchiveDir") {
+			rc.archiveDir = filepath.Join(rc.archiveDir, name)
+		}
+		if !k.section.HasKey("FailedDir") {
+			rc.failedDir = filepath.Join(rc.failedDir, name)
+		}
+	}
+
+	rc.numWorkers = k.key("Goroutines", "numWorkers").MustInt()
+
+	var err error
+	rc.filter, err = newFileFilter(
+		splitList(k.key("Directories", "Include").String()),
+		splitList(k.key("Directories", "Exclude").String()),
+		k.key("Directories", "IncludeRegex").String(),
+		k.key("Directories", "ExcludeRegex").String(),
+		k.key("Directories", "IgnoredDir").String())
+	if err != nil {
+		return rc, err
+	}
+
+	rc.readiness = readinessConfig{
+		strategy:       k.key("Directories", "Readiness").String(),
+		minAge:         k.key("Directories", "MinFileAge").MustDuration(),
+		stableScans:    k.key("Directories", "StableScans").MustInt(),
+		markerSuffixes: splitList(k.key("Directories", "MarkerSuffixes").String()),
+		tempSuffixes:   splitList(k.key("Directories", "TempSuffixes").String()),
+	}
+
+	rc.recursive = k.key("Directories", "Recursive").MustBool()
+	rc.watchMode = k.key("Directories", "WatchMode").String()
+	rc.pollInterval = k.key("Directories", "PollInterval").MustDuration()
+	rc.rescanInterval = k.key("Directories", "RescanInterval").MustDuration()
+
+	// Значения уже проверены в validateConfig
+	rc.chunkSize, _ = parseSize(k.key("Upload", "ChunkSize").String())
+	rc.chunkThreshold, _ = parseSize(k.key("Upload", "ChunkThreshold").String())
+	rc.compression = k.key("Upload", "Compression").String()
+	rc.skipCompression = splitList(k.key("Upload", "SkipCompression").String())
+
+	rc.recipients, err = loadRecipients(
+		splitList(k.key("Encryption", "Recipients").String()),
+		k.key("Encryption", "RecipientsFile").String())
+	if err != nil {
+		return rc, err
+	}
+	rc.stagingDir = k.key("Encryption", "StagingDir").String()
+	if k.section != nil && !k.section.HasKey("StagingDir") {
+		rc.stagingDir = filepath.Join(rc.stagingDir, name)
+	}
+
+	rc.schedule, err = parseSchedule(
+		splitList(k.key("Schedule", "Windows").String()),
+		splitList(k.key("Schedule", "Blackout").String()),
+		k.key("Schedule", "TimeZone").String())
+	if err != nil {
+		return rc, err
+	}
+
+	rc.priority = priorityConfig{
+		order:    k.key("Priority", "Order").String(),
+		high:     k.key("Priority", "HighPriority").MustInt(),
+		reserved: k.key("Priority", "ReservedWorkers").MustInt(),
+	}
+	if rc.priority.rules, err = parsePriorityRules(splitList(k.key("Priority", "Rules").String())); err != nil {
+		return rc, err
+	}
+	if rc.priority.reserved >= rc.numWorkers {
+		return rc, fmt.Errorf("[Priority] ReservedWorkers (%d) must be less than numWorkers (%d)", rc.priority.reserved, rc.numWorkers)
+	}
+
+	rc.bundle = bundleConfig{
+		format:   k.key("Bundle", "Format").String(),
+		maxWait:  k.key("Bundle", "MaxWait").MustDuration(),
+		maxFiles: k.key("Bundle", "MaxFiles").MustInt(),
+	}
+	rc.bundle.maxSize, _ = parseSize(k.key("Bundle", "MaxSize").String())
+	rc.bundle.maxFileSize, _ = parseSize(k.key("Bundle", "MaxFileSize").String())
+
+	rc.retention = retentionConfig{
+		keepRawDays:     k.key("Archive", "KeepRawDays").MustInt(),
+		deleteAfterDays: k.key("Archive", "DeleteAfterDays").MustInt(),
+		dryRun:          k.key("Archive", "DryRun").MustBool(),
+		checkInterval:   k.key("Archive", "CheckInterval").MustDuration(),
+	}
+	rc.retention.maxTotalSize, _ = parseSize(k.key("Archive", "MaxTotalSize").String())
+
+	rc.bandwidth, _ = parseSize(k.key("Limits", "Bandwidth").String())
+	rc.maxConcurrent = k.key("Limits", "MaxConcurrent").MustInt()
+
+	rc.retry = retryPolicy{
+		maxAttempts: k.key("Retry", "MaxAttempts").MustInt(),
+		baseBackoff: k.key("Retry", "BaseBackoff").MustDuration(),
+		maxBackoff:  k.key("Retry", "MaxBackoff").MustDuration(),
+		jitter:      k.key("Retry", "Jitter").MustFloat64(),
+	}
+
+	return rc, nil
+}
+
+// recordSent обновляет статистику направления после успешной отправки файла
+func (r *route) recordSent(name string, size int64) {
+	r.stats.mu.Lock()
+	r.stats.filesSent++
+	r.stats.bytesSent += size
+	r.stats.lastName = name
+	r.stats.lastTime = time.Now()
+	filesSent, bytesSent, lastTime := r.stats.filesSent, r.stats.bytesSent, r.stats.lastTime
+	r.stats.mu.Unlock()
+
+	metricFilesSent.WithLabelValues(r.name).Inc()
+	metricBytesSent.WithLabelValues(r.name).Add(float64(size))
+	metricLastSuccess.WithLabelValues(r.name).Set(float64(lastTime.Unix()))
+
+	totalBytesSentMB := float64(bytesSent) / (1024 * 1024)
+	fmt.Printf("[%s] File successfully sent: %s | Number of files sent: %d | Total size: %.2f MB | Last file: %s at %s\n",
+		r.name, name, filesSent, totalBytesSentMB, name, lastTime.Format(time.RFC3339))
+}
+
+// logStats записывает в лог итоговую статистику направления
+func (r *route) logStats() {
+	r.stats.mu.Lock()
+	defer r.stats.mu.Unlock()
+
+	log.Info().Msg(fmt.Sprintf("Route %s: files sent %d, total size %.2f MB, last file %s",
+		r.name, r.stats.filesSent, float64(r.stats.bytesSent)/(1024*1024), r.stats.lastName))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // TimeZone на Windows без установленной базы часовых поясов
+
+	"github.com/rs/zerolog/log"
+)
+
+// Как часто проверяется смена окна отправки
+const scheduleCheckInterval = 30 * time.Second
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// timeWindow - интервал времени вида "Mon-Fri 09:00-18:00" или "22:00-06:00".
+// Интервал может переходить через полночь, тогда дни относятся к его началу
+type timeWindow struct {
+	days       [7]bool // по time.Weekday, все false - любой день
+	start, end int     // минуты от начала суток, end может быть 24:00
+}
+
+// schedule - окна, в которые разрешена отправка ([Schedule] Windows), и
+// окна запрета ([Schedule] Blackout). Запрет важнее разрешения
+type schedule struct {
+	windows   []timeWindow
+	blackouts []timeWindow
+	location  *time.Location
+}
+
+func parseSchedule(windows, blackouts []string, timeZone string) (schedule, error) {
+	s := schedule{location: time.Local}
+	if timeZone != "" && timeZone != "Local" {
+		location, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return s, fmt.Errorf("[Schedule] TimeZone: %v", err)
+		}
+		s.location = location
+	}
+	for _, spec := range windows {
+		window, err := parseTimeWindow(spec)
+		if err != nil {
+			return s, fmt.Errorf("[Schedule] Windows: %v", err)
+		}
+		s.windows = append(s.windows, window)
+	}
+	for _, spec := range blackouts {
+		window, err := parseTimeWindow(spec)
+		if err != nil {
+			return s, fmt.Errorf("[Schedule] Blackout: %v", err)
+		}
+		s.blackouts = append(s.blackouts, window)
+	}
+	return s, nil
+}
+
+func parseTimeWindow(spec string) (timeWindow, error) {
+	var w timeWindow
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return w, fmt.Errorf("%q is not a time window (examples: 09:00-18:00, Mon-Fri 22:00-06:00)", spec)
+	}
+
+	if len(fields) == 2 {
+		first, last, _ := strings.Cut(strings.ToLower(fields[0]), "-")
+		if last == "" {
+			last = first
+		}
+		from, ok1 := weekdays[first]
+		to, ok2 := weekdays[last]
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("%q: days must be like Mon, Sat-Sun or Mon-Fri", spec)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			w.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(fields[len(fields)-1], "-")
+	var err error
+	if ok {
+		if w.start, err = parseClock(start); err == nil {
+			w.end, err = parseClock(end)
+		}
+	}
+	if !ok || err != nil || w.start == w.end {
+		return w, fmt.Errorf("%q: time must be like 09:00-18:00", spec)
+	}
+	return w, nil
+}
+
+// parseClock разбирает время HH:MM в минуты от начала суток, допускается 24:00
+func parseClock(value string) (int, error) {
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return h*60 + m, nil
+}
+
+func (w timeWindow) onDay(day time.Weekday) bool {
+	return w.days == [7]bool{} || w.days[day]
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.onDay(t.Weekday()) && minute >= w.start && minute < w.end
+	}
+	// Через полночь: вечер дня начала или утро следующего дня
+	if minute >= w.start {
+		return w.onDay(t.Weekday())
+	}
+	return minute < w.end && w.onDay((t.Weekday()+6)%7)
+}
+
+// open проверяет, разрешена ли отправка в момент t
+func (s schedule) open(t time.Time) bool {
+	t = t.In(s.location)
+	for _, w := range s.blackouts {
+		if w.contains(t) {
+			return false
+		}
+	}
+	if len(s.windows) == 0 {
+		return true
+	}
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleAllows - вне окна отправки файлы остаются в очереди, кроме отправленных
+// вне расписания через API управления (POST /push)
+func (r *route) scheduleAllows(filePath string) bool {
+	if r.config().schedule.open(time.Now()) {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pushed[filePath]
+}
+
+// watchSchedule записывает в лог открытие и закрытие окна отправки и при открытии
+// проверяет каталог, чтобы сразу отправить накопившиеся файлы
+func watchSchedule(r *route) {
+	wasOpen := r.config().schedule.open(time.Now())
+	if !wasOpen {
+		log.Info().Msg(fmt.Sprintf("Route %s: outside the transfer window, new files are held", r.name))
+	}
+
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopping.Done():
+			return
+		case <-ticker.C:
+		}
+
+		open := r.config().schedule.open(time.Now())
+		if open == wasOpen {
+			continue
+		}
+		wasOpen = open
+		if open {
+			log.Info().Msg(fmt.Sprintf("Route %s: transfer window opened", r.name))
+			go scanDir(r)
+		} else {
+			log.Info().Msg(fmt.Sprintf("Route %s: transfer window closed, new files are held", r.name))
+			r.releaseQueued(false)
+		}
+	}
+}
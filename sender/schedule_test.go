@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		spec       string
+		days       []time.Weekday // nil - любой день
+		start, end int
+		wantErr    bool
+	}{
+		{spec: "09:00-18:00", start: 9 * 60, end: 18 * 60},
+		{spec: "22:00-06:00", start: 22 * 60, end: 6 * 60},
+		{spec: "18:00-24:00", start: 18 * 60, end: 24 * 60},
+		{spec: "00:00-24:00", start: 0, end: 24 * 60},
+		{spec: "Mon-Fri 09:00-18:00", days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, start: 9 * 60, end: 18 * 60},
+		{spec: "sat 10:00-12:30", days: []time.Weekday{time.Saturday}, start: 10 * 60, end: 12*60 + 30},
+		{spec: "Fri-Mon 22:00-06:00", days: []time.Weekday{time.Friday, time.Saturday, time.Sunday, time.Monday}, start: 22 * 60, end: 6 * 60},
+		{spec: "", wantErr: true},
+		{spec: "09:00", wantErr: true},
+		{spec: "09:00-09:00", wantErr: true},
+		{spec: "09:00-24:01", wantErr: true},
+		{spec: "25:00-26:00", wantErr: true},
+		{spec: "09:60-10:00", wantErr: true},
+		{spec: "9am-5pm", wantErr: true},
+		{spec: "Mon-Fru 09:00-18:00", wantErr: true},
+		{spec: "Mon Tue 09:00-18:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		w, err := parseTimeWindow(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTimeWindow(%q): expected an error, got %+v", tt.spec, w)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTimeWindow(%q): %v", tt.spec, err)
+			continue
+		}
+		var days [7]bool
+		for _, day := range tt.days {
+			days[day] = true
+		}
+		if w.days != days || w.start != tt.start || w.end != tt.end {
+			t.Errorf("parseTimeWindow(%q) = %+v, want days %v, %d-%d", tt.spec, w, tt.days, tt.start, tt.end)
+		}
+	}
+}
+
+func TestScheduleOpen(t *testing.T) {
+	// 5 января 2024 года - пятница
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	fri, sat, sun, mon := 5, 6, 7, 8
+
+	tests := []struct {
+		name      string
+		windows   []string
+		blackouts []string
+		at        time.Time
+		want      bool
+	}{
+		{name: "no windows", at: at(fri, 12, 0), want: true},
+		{name: "inside window", windows: []string{"09:00-18:00"}, at: at(fri, 9, 0), want: true},
+		{name: "window end is exclusive", windows: []string{"09:00-18:00"}, at: at(fri, 18, 0), want: false},
+		{name: "outside window", windows: []string{"09:00-18:00"}, at: at(fri, 8, 59), want: false},
+		{name: "weekday window on weekend", windows: []string{"Mon-Fri 09:00-18:00"}, at: at(sat, 12, 0), want: false},
+
+		{name: "overnight evening", windows: []string{"22:00-06:00"}, at: at(fri, 23, 0), want: true},
+		{name: "overnight morning", windows: []string{"22:00-06:00"}, at: at(sat, 5, 59), want: true},
+		{name: "overnight daytime", windows: []string{"22:00-06:00"}, at: at(sat, 12, 0), want: false},
+		{name: "overnight day range, next morning", windows: []string{"Fri 22:00-06:00"}, at: at(sat, 3, 0), want: true},
+		{name: "overnight day range, same morning", windows: []string{"Fri 22:00-06:00"}, at: at(fri, 3, 0), want: false},
+		{name: "overnight day range, other evening", windows: []string{"Fri 22:00-06:00"}, at: at(sat, 23, 0), want: false},
+		{name: "overnight weekdays, Monday morning", windows: []string{"Mon-Fri 22:00-06:00"}, at: at(mon, 3, 0), want: false},
+		{name: "overnight weekdays, Saturday morning", windows: []string{"Mon-Fri 22:00-06:00"}, at: at(sat, 3, 0), want: true},
+		{name: "wrapping day range", windows: []string{"Sat-Sun 10:00-12:00"}, at: at(sun, 11, 0), want: true},
+
+		{name: "24:00 end, last minute", windows: []string{"18:00-24:00"}, at: at(fri, 23, 59), want: true},
+		{name: "24:00 end, midnight", windows: []string{"18:00-24:00"}, at: at(sat, 0, 0), want: false},
+		{name: "whole day", windows: []string{"Sun 00:00-24:00"}, at: at(sun, 23, 59), want: true},
+		{name: "whole day, other day", windows: []string{"Sun 00:00-24:00"}, at: at(mon, 0, 0), want: false},
+
+		{name: "blackout without windows", blackouts: []string{"12:00-13:00"}, at: at(fri, 12, 30), want: false},
+		{name: "outside blackout", blackouts: []string{"12:00-13:00"}, at: at(fri, 13, 0), want: true},
+		{name: "blackout overrides window", windows: []string{"09:00-18:00"}, blackouts: []string{"12:00-13:00"}, at: at(fri, 12, 0), want: false},
+		{name: "blackout overrides overnight window", windows: []string{"22:00-06:00"}, blackouts: []string{"Sat 02:00-04:00"}, at: at(sat, 3, 0), want: false},
+		{name: "blackout on other day", windows: []string{"22:00-06:00"}, blackouts: []string{"Sun 02:00-04:00"}, at: at(sat, 3, 0), want: true},
+		{name: "overnight blackout over day window", windows: []string{"00:00-24:00"}, blackouts: []string{"Fri 23:00-01:00"}, at: at(sat, 0, 30), want: false},
+		{name: "any of several windows", windows: []string{"01:00-02:00", "Sat 10:00-11:00"}, at: at(sat, 10, 15), want: true},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.windows, tt.blackouts, "UTC")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := s.open(tt.at); got != tt.want {
+			t.Errorf("%s: open(%s) = %v, want %v", tt.name, tt.at.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestScheduleOpenUsesTimeZone(t *testing.T) {
+	s, err := parseSchedule([]string{"09:00-18:00"}, nil, "Europe/Moscow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 07:00 UTC - 10:00 по Москве
+	if !s.open(time.Date(2024, 1, 5, 7, 0, 0, 0, time.UTC)) {
+		t.Error("07:00 UTC must be inside 09:00-18:00 Moscow time")
+	}
+	if s.open(time.Date(2024, 1, 5, 16, 0, 0, 0, time.UTC)) {
+		t.Error("16:00 UTC must be outside 09:00-18:00 Moscow time")
+	}
+}
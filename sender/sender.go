@@ -1,415 +1,384 @@
 package main
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"gopkg.in/ini.v1"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"hash"
 	"io"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	totalFilesSent   int
-	totalBytesSent   int64
-	lastFileSentName string
-	lastFileSentTime time.Time
-	fileFirstSeen    = make(map[string]time.Time)
-	fileMutex        sync.Mutex
-
 	// Конфигурационные переменные
-	serverAddr string
-	username   string
-	password   string
-	sendDir    string
-	archiveDir string
-	logDir     string
-	logFile    string
-	useHTTPS   bool
-	certFile   string
-	keyFile    string
-	numWorkers int
-)
+	logDir      string
+	logFile     string
+	watchConfig bool
 
-func init() {
-	createConfigIfNotExists()
-	updateConfigIfNeeded()
+	// Источник конфигурации, используется и при перечитывании
+	configSrc configSource
+)
 
-	var err error
-	cfg, err := ini.Load("config.ini")
-	if err != nil {
-		log.Error().Msg(fmt.Sprintf("error loading the config.ini file: %s", err))
+func createDirectories() {
+	dirs := []string{logDir}
+	for _, r := range routes {
+		cfg := r.config()
+		dirs = append(dirs, cfg.sendDir, cfg.archiveDir, cfg.failedDir)
+		if cfg.usesStaging() {
+			dirs = append(dirs, cfg.stagingDir)
+		}
 	}
-
-	useHTTPS, _ = cfg.Section("Server").Key("UseHTTPS").Bool()
-	protocol := "http"
-	if useHTTPS {
-		protocol = "https"
-		certFile = cfg.Section("Server").Key("CertFile").String()
-		keyFile = cfg.Section("Server").Key("KeyFile").String()
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Error().Msg(fmt.Sprintf("error creating directory %s: %v", dir, err))
+		}
 	}
-
-	serverAddr = fmt.Sprintf("%s://%s:%s/%s",
-		protocol,
-		cfg.Section("Server").Key("Host").String(),
-		cfg.Section("Server").Key("Port").String(),
-		cfg.Section("Server").Key("Context").String())
-
-	username = cfg.Section("Auth").Key("Username").String()
-	password = cfg.Section("Auth").Key("Password").String()
-
-	sendDir = cfg.Section("Directories").Key("SendDir").String()
-	archiveDir = cfg.Section("Directories").Key("ArchiveDir").String()
-	logDir = cfg.Section("Directories").Key("LogDir").String()
-
-	logFile = cfg.Section("File").Key("LogFile").String()
-	numWorkers, _ = cfg.Section("Goroutines").Key("numWorkers").Int()
-
 }
 
-func createConfigIfNotExists() {
-	if _, err := os.Stat("config.ini"); os.IsNotExist(err) {
-		log.Info().Msg("The config.ini file was not found. Creating a new configuration file.")
-
-		cfg := ini.Empty()
-
-		cfg.Section("Server").Key("Host").SetValue("transport.ipay.ua")
-		cfg.Section("Server").Key("Port").SetValue("14080")
-		cfg.Section("Server").Key("Context").SetValue("upload")
-		cfg.Section("Server").Key("UseHTTPS").SetValue("true")
-		cfg.Section("Server").Key("CertFile").SetValue("server.crt")
-		cfg.Section("Server").Key("KeyFile").SetValue("server.key")
-
-		cfg.Section("Auth").Key("Username").SetValue("admin")
-		cfg.Section("Auth").Key("Password").SetValue("password")
-
-		cfg.Section("Directories").Key("SendDir").SetValue("./send/")
-		cfg.Section("Directories").Key("ArchiveDir").SetValue("./archive/")
-		cfg.Section("Directories").Key("LogDir").SetValue("./logs/")
-
-		cfg.Section("File").Key("LogFile").SetValue("app_daily.log")
+func main() {
+	// sender decrypt - расшифровка файлов, полученных сервером
+	if len(os.Args) > 1 && os.Args[1] == "decrypt" {
+		os.Exit(runDecrypt(os.Args[2:]))
+	}
 
-		cfg.Section("Goroutines").Key("numWorkers").SetValue("8")
+	configPath := flag.String("config", "config.ini", "path to the configuration file")
+	printOnly := flag.Bool("print-config", false, "print the effective configuration with secrets hidden and exit")
+	var overrides listFlag
+	flag.Var(&overrides, "set", "override a config value, e.g. -set Server.Host=example.com (can be repeated)")
+	flag.Parse()
 
-		err := cfg.SaveTo("config.ini")
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("error creating the config.ini file: %s", err))
+	configSrc = configSource{path: *configPath, set: overrides}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configSrc.explicit = true
 		}
+	})
 
-		log.Info().Msg("The config.ini file was successfully created with default settings.")
-	}
-}
-
-func updateConfigIfNeeded() {
-	// Загружаем существующий файл конфигурации
-	cfg, err := ini.Load("config.ini")
+	conf, cfg, err := loadConfig(configSrc)
 	if err != nil {
-		log.Error().Msg(fmt.Sprintf("error loading configuration: %v", err))
+		fmt.Fprintf(os.Stderr, "error in the configuration:\n%v\n", err)
+		os.Exit(1)
 	}
-
-	// Проверяем, существует ли секция [Server]
-	section, err := cfg.GetSection("Server")
-	if err != nil {
-		// Если секция не существует, создаем ее
-		section, err = cfg.NewSection("Server")
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("error creating the [Server] section: %v", err))
-		}
-		log.Info().Msg("Section [Server] created")
+	if *printOnly {
+		printConfig(os.Stdout, cfg)
+		return
 	}
 
-	// Проверяем, существует ли ключ Host
-	if section.Key("Host").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("Host").SetValue("transport.ipay.ua")
-		log.Info().Msg("Added value Host = transport.ipay.ua to the [Server] section")
+	logDir, logFile, watchConfig = conf.logDir, conf.logFile, conf.watchConfig
+	totalBandwidth.SetLimit(bandwidthLimit(conf.totalBandwidth))
+	for _, rc := range conf.routes {
+		routes = append(routes, newRoute(rc))
 	}
+	startMetricsServer(conf.metricsListen, conf.metricsPath)
+	startAdminServer(conf.adminListen)
 
-	// Проверяем, существует ли ключ Port
-	if section.Key("Port").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("Port").SetValue("14080")
-		log.Info().Msg("Added value Port = 14080 to the [Server] section")
-	}
+	createDirectories()
 
-	// Проверяем, существует ли ключ Context
-	if section.Key("Context").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("Context").SetValue("upload")
-		log.Info().Msg("Added value Context = upload to the [Server] section")
+	logFilePath := filepath.Join(logDir, logFile)
+	logWriter := &lumberjack.Logger{
+		Filename:   logFilePath, // Имя файла лога
+		MaxSize:    10,          // Максимальный размер файла в МБ
+		MaxBackups: 0,           // Максимальное количество резервных файлов
+		MaxAge:     0,           // Максимальный возраст резервных файлов в днях
+		Compress:   true,        // Сжимать резервные файлы
 	}
 
-	// Проверяем, существует ли ключ UseHTTPS
-	if section.Key("UseHTTPS").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("UseHTTPS").SetValue("true")
-		log.Info().Msg("Added value UseHTTPS = true to the [Server] section")
-	}
+	// Настройка вывода логов через lumberjack
+	log.Logger = log.Output(logWriter)
 
-	// Проверяем, существует ли ключ CertFile
-	if section.Key("CertFile").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("CertFile").SetValue("server.crt")
-		log.Info().Msg("Added value CertFile = server.crt to the [Server] section")
-	}
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
-	// Проверяем, существует ли ключ KeyFile
-	if section.Key("KeyFile").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("KeyFile").SetValue("server.key")
-		log.Info().Msg("Added value KeyFile = server.key to the [Server] section")
+	log.Info().Msg("Starting the file transfer program...")
+	for _, r := range routes {
+		log.Info().Msg(fmt.Sprintf("Route %s: %s -> %s", r.name, r.config().sendDir, r.config().serverAddr))
 	}
 
-	// Проверяем, существует ли секция [Auth]
-	section, err = cfg.GetSection("Auth")
+	// Открываем журнал доставки и восстанавливаем состояние после перезапуска
+	fileJournal, err = openJournal(logDir)
 	if err != nil {
-		// Если секция не существует, создаем ее
-		section, err = cfg.NewSection("Auth")
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("error creating the [Auth] section: %v", err))
-		}
-		log.Info().Msg("Section [Auth] created")
+		log.Fatal().Msg(fmt.Sprintf("error opening the delivery journal: %v", err))
 	}
+	resumeFromJournal()
 
-	// Проверяем, существует ли ключ Username
-	if section.Key("Username").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("Username").SetValue("admin")
-		log.Info().Msg("Added value Username = admin to the [Auth] section")
-	}
+	// У каждого направления свой канал файлов и свой пул обработчиков
+	for _, r := range routes {
+		go watchFiles(r)
+		go watchSchedule(r)
+		go runJanitor(r)
+		r.workerWG.Add(1)
+		go func(r *route) {
+			defer r.workerWG.Done()
+			runBundler(r)
+		}(r)
 
-	// Проверяем, существует ли ключ Password
-	if section.Key("Password").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("Password").SetValue("password")
-		log.Info().Msg("Added value Password = password to the [Auth] section")
+		log.Info().Msg(fmt.Sprintf("Route %s: starting with %d chanals", r.name, r.config().numWorkers))
+		r.resizeWorkers(r.config().numWorkers)
 	}
 
-	// Проверяем, существует ли секция [Directories]
-	section, err = cfg.GetSection("Directories")
-	if err != nil {
-		// Если секция не существует, создаем ее
-		section, err = cfg.NewSection("Directories")
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("error creating the [Directories] section: %v", err))
-		}
-		log.Info().Msg("Section [Directories] created")
-	}
+	// Настройки можно перечитать без перезапуска: kill -HUP <pid>
+	startConfigReload(watchConfig)
 
-	// Проверяем, существует ли ключ SendDir
-	if section.Key("SendDir").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("SendDir").SetValue("./send/")
-		log.Info().Msg("Added value SendDir = ./send/ to the [Directories] section")
-	}
+	// Работаем до сигнала завершения, затем дожидаемся текущих отправок
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	signal.Stop(c)
+	shutdown(conf.shutdownGrace, logWriter)
+}
 
-	// Проверяем, существует ли ключ ArchiveDir
-	if section.Key("ArchiveDir").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("ArchiveDir").SetValue("./archive/")
-		log.Info().Msg("Added value ArchiveDir = ./archive/ to the [Directories] section")
-	}
+// Изменяем функцию watchFiles для отправки файлов в канал направления
+func watchFiles(r *route) {
+	log.Info().Msg(fmt.Sprintf("Start monitoring folder: %s", r.config().sendDir))
 
-	// Проверяем, существует ли ключ LogDir
-	if section.Key("LogDir").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("LogDir").SetValue("./logs/")
-		log.Info().Msg("Added value LogDir = ./logs/ to the [Directories] section")
+	// По возможности следим за каталогом по событиям файловой системы
+	if r.config().watchMode != "poll" {
+		err := watchFilesNotify(r)
+		if err == nil {
+			return
+		}
+		log.Error().Msg(fmt.Sprintf("file system events are unavailable for %s, falling back to polling: %v", r.config().sendDir, err))
 	}
 
-	// Проверяем, существует ли секция [File]
-	section, err = cfg.GetSection("File")
-	if err != nil {
-		// Если секция не существует, создаем ее
-		section, err = cfg.NewSection("File")
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("error creating the [File] section: %v", err))
+	for {
+		scanDir(r)
+		select {
+		case <-stopping.Done():
+			return
+		case <-time.After(r.config().pollInterval):
 		}
-		log.Info().Msg("Section [File] created")
 	}
+}
 
-	// Проверяем, существует ли ключ LogFile
-	if section.Key("LogFile").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("LogFile").SetValue("app_daily.log")
-		log.Info().Msg("Added value LogFile = app_daily.log to the [File] section")
-	}
+// scanDir проверяет все файлы каталога отправки
+func scanDir(r *route) {
+	currentFiles := make(map[string]bool)
+	sendDir := r.config().sendDir
+
+	if r.config().recursive {
+		// Обходим вложенные каталоги, пропуская служебные
+		err := filepath.WalkDir(sendDir, func(filePath string, file os.DirEntry, err error) error {
+			if err != nil {
+				log.Info().Msg(fmt.Sprintf("error reading the directory: %s", err))
+				return nil
+			}
+			if file.IsDir() {
+				if filePath != sendDir && r.isServiceDir(filePath) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			currentFiles[filePath] = true
 
-	// Проверяем, существует ли секция [Goroutines]
-	section, err = cfg.GetSection("Goroutines")
-	if err != nil {
-		// Если секция не существует, создаем ее
-		section, err = cfg.NewSection("Goroutines")
+			if info, err := file.Info(); err == nil {
+				checkFile(r, filePath, info)
+			}
+			return nil
+		})
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("error creating the [Goroutines] section: %v", err))
+			log.Info().Msg(fmt.Sprintf("error reading the directory: %s", err))
+			return
+		}
+	} else {
+		files, err := os.ReadDir(sendDir)
+		if err != nil {
+			log.Info().Msg(fmt.Sprintf("error reading the directory: %s", err))
+			return
 		}
-		log.Info().Msg("Section [Goroutines] created")
-	}
 
-	// Проверяем, существует ли ключ numWorkers
-	if section.Key("numWorkers").String() == "" {
-		// Если ключ не существует, устанавливаем значение по умолчанию
-		section.Key("numWorkers").SetValue("8")
-		log.Info().Msg("Added value numWorkers = 8 to the [Goroutines] section")
-	}
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			filePath := filepath.Join(sendDir, file.Name())
+			currentFiles[filePath] = true
 
-	// Сохраняем изменения в конфигурации
-	err = cfg.SaveTo("config.ini")
-	if err != nil {
-		log.Error().Msg(fmt.Sprintf("error saving configuration: %v", err))
+			info, err := file.Info()
+			if err != nil {
+				continue
+			}
+			checkFile(r, filePath, info)
+		}
 	}
-}
 
-func createDirectories() {
-	dirs := []string{sendDir, archiveDir, logDir}
-	for _, dir := range dirs {
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			log.Error().Msg(fmt.Sprintf("error creating directory %s: %v", dir, err))
+	// Удаляем из карты файлы, которых больше нет в директории
+	r.mu.Lock()
+	for filePath := range r.firstSeen {
+		if !currentFiles[filePath] {
+			r.forgetFileLocked(filePath)
+		}
+	}
+	for filePath := range r.ignored {
+		if !currentFiles[filePath] {
+			delete(r.ignored, filePath)
 		}
 	}
+	r.mu.Unlock()
 }
 
-func main() {
-	createDirectories()
-
-	logFilePath := filepath.Join(logDir, logFile)
-	logWriter := &lumberjack.Logger{
-		Filename:   logFilePath, // Имя файла лога
-		MaxSize:    10,          // Максимальный размер файла в МБ
-		MaxBackups: 0,           // Максимальное количество резервных файлов
-		MaxAge:     0,           // Максимальный возраст резервных файлов в днях
-		Compress:   true,        // Сжимать резервные файлы
+// checkFile регистрирует новый файл и отправляет его в канал, когда он готов к отправке
+func checkFile(r *route, filePath string, info os.FileInfo) {
+	if r.config().readiness.isIgnored(info.Name()) {
+		return
+	}
+	if !r.config().filter.allows(info.Name()) {
+		ignoreFile(r, filePath)
+		return
 	}
 
-	// Настройка вывода логов через lumberjack
-	log.Logger = log.Output(logWriter)
-
-	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-
-	log.Info().Msg("Starting the file transfer program...")
-	log.Info().Msg(fmt.Sprintf("Server address in use: %s", serverAddr))
+	r.mu.Lock()
+	_, exists := r.firstSeen[filePath]
+	if !exists {
+		r.firstSeen[filePath] = time.Now()
+		log.Info().Msg(fmt.Sprintf("New file detected: %s", filePath))
+	}
+	firstSeen := r.firstSeen[filePath]
+	r.mu.Unlock()
 
-	// Create the file channel
-	fileChan := make(chan string)
+	if !exists {
+		metricFilesDetected.WithLabelValues(r.name).Inc()
+		fileJournal.record(journalEntry{
+			Path:      filePath,
+			State:     stateDetected,
+			FirstSeen: firstSeen,
+			Size:      info.Size(),
+			ModTime:   info.ModTime(),
+		})
+	}
+
+	if isFileReady(r, filePath, info) {
+		// Файл уже обрабатывается или ждет повторной попытки - в канал не отправляем.
+		// На время паузы и вне окна отправки файлы остаются в очереди
+		if r.paused.Load() || !r.scheduleAllows(filePath) || !r.retryDue(filePath) || !r.claimFile(filePath) {
+			return
+		}
+		log.Info().Msg(fmt.Sprintf("The file %s is ready (%s). Sending...", filePath, r.config().readiness.strategy))
+		r.dispatch(filePath, info) // Ставим файл в очередь обработчиков
+	} else {
+		log.Info().Msg(fmt.Sprintf("The file %s is not ready for sending yet", filePath))
+	}
+}
 
-	go watchFiles(fileChan)
+// forgetFileLocked прекращает отслеживание файла, которого больше нет в каталоге.
+// Вызывается под r.mu
+func (r *route) forgetFileLocked(filePath string) {
+	delete(r.firstSeen, filePath)
+	delete(r.inFlight, filePath)
+	delete(r.retries, filePath)
+	delete(r.observations, filePath)
+	delete(r.pushed, filePath)
+	if _, ok := fileJournal.lookup(filePath); ok {
+		fileJournal.record(journalEntry{Path: filePath, State: stateRemoved})
+	}
+	log.Info().Msg(fmt.Sprintf("The file has been removed from tracking: %s", filePath))
+}
 
-	// // Start goroutines for sending files
-	// startSendGoroutines(5, fileChan) // Adjust the number of goroutines as needed
+// claimFile закрепляет файл за обработчиком. Возвращает false, если файл уже в работе
+func (r *route) claimFile(filePath string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	// Start goroutines for sending files
-	log.Info().Msg(fmt.Sprintf("Starting with %d chanals", numWorkers))
-	var wg sync.WaitGroup
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			sendFileWorker(fileChan)
-		}()
+	if r.inFlight[filePath] {
+		return false
 	}
+	r.inFlight[filePath] = true
+	delete(r.pushed, filePath)
+	return true
+}
 
-	// Запись в лог при завершении программы
-	exitHandler := func() {
-		log.Info().Msg("Terminating the file transfer program...")
-		os.Exit(0)
-	}
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		<-c
-		exitHandler()
-	}()
-
-	wg.Wait()
-	//select {} // Бесконечный цикл, чтобы программа не завершалась
+// releaseFile снимает закрепление, чтобы файл можно было отправить повторно
+func (r *route) releaseFile(filePath string) {
+	r.mu.Lock()
+	delete(r.inFlight, filePath)
+	r.mu.Unlock()
 }
 
-// Изменяем функцию watchFiles для отправки файлов в канал
-func watchFiles(fileChan chan<- string) {
-	log.Info().Msg(fmt.Sprintf("Start monitoring folder: %s", sendDir))
+// Функция для обработки отправки файлов
+func sendFileWorker(r *route) {
 	for {
-		files, err := os.ReadDir(sendDir)
-		if err != nil {
-			log.Info().Msg(fmt.Sprintf("error reading the directory: %s", err))
-			time.Sleep(1 * time.Second)
-			continue
+		// Уменьшение пула не ждет, пока очередь опустеет
+		select {
+		case <-r.stopWorker:
+			return
+		default:
 		}
 
-		currentFiles := make(map[string]bool)
-
-		for _, file := range files {
-			if !file.IsDir() {
-				filePath := filepath.Join(sendDir, file.Name())
-				currentFiles[filePath] = true
-
-				fileMutex.Lock()
-				if _, exists := fileFirstSeen[filePath]; !exists {
-					fileFirstSeen[filePath] = time.Now()
-					log.Info().Msg(fmt.Sprintf("New file detected: %s", filePath))
-				}
-				fileMutex.Unlock()
-
-				if isFileUnchanged(filePath) {
-					log.Info().Msg(fmt.Sprintf("The file %s has not been modified for more than 10 seconds. Sending...", filePath))
-					fileChan <- filePath // Отправляем файл в канал
-				} else {
-					log.Info().Msg(fmt.Sprintf("The file %s is not ready for sending yet", filePath))
-				}
-			}
+		file, wait, ok := r.queue.take(r.config())
+		if !ok {
+			return
 		}
-
-		// Удаляем из карты файлы, которых больше нет в директории
-		fileMutex.Lock()
-		for filePath := range fileFirstSeen {
-			if !currentFiles[filePath] {
-				delete(fileFirstSeen, filePath)
-				log.Info().Msg(fmt.Sprintf("The file has been removed from tracking: %s", filePath))
+		if file == nil {
+			select {
+			case <-r.stopWorker:
+				return
+			case <-wait:
 			}
+			continue
 		}
-		fileMutex.Unlock()
-		time.Sleep(1 * time.Second)
+
+		processFile(r, file.path)
+		r.queue.done(file)
 	}
 }
 
-func isFileUnchanged(filePath string) bool {
-	fileMutex.Lock()
-	firstSeen, exists := fileFirstSeen[filePath]
-	fileMutex.Unlock()
-
-	if !exists {
-		return false
+// processFile отправляет файл и по результату перемещает его в архив, назначает
+// повторную попытку или снимает закрепление
+func processFile(r *route, filePath string) {
+	if r.addToBundle(filePath) {
+		return
+	}
+	err := sendFile(r, filePath)
+	if errors.Is(err, context.Canceled) {
+		// Отправка прервана при завершении работы и продолжится после запуска
+		log.Info().Msg(fmt.Sprintf("Sending of %s was interrupted by shutdown", filePath))
+		r.releaseFile(filePath)
+		return
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		log.Error().Msg(fmt.Sprintf("error sending the file: %s", err))
+		r.releaseFile(filePath)
+		return
+	}
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("error sending the file: %s", err))
+		handleSendFailure(r, filePath, err)
+		return
 	}
 
-	return time.Since(firstSeen) > 2*time.Second
-}
-
-// Функция для обработки отправки файлов
-func sendFileWorker(fileChan <-chan string) {
-	for filePath := range fileChan {
-		err := sendFile(filePath)
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("error sending the file: %s", err))
-		}
+	// После успешной отправки файл остается закрепленным, пока не исчезнет из каталога.
+	// Если переместить его в архив не удалось, разрешаем повторную попытку
+	if _, err := os.Stat(filePath); err == nil {
+		r.releaseFile(filePath)
 	}
 }
 
-func sendFile(filePath string) error {
+func sendFile(r *route, filePath string) error {
 	log.Info().Msg(fmt.Sprintf("Starting file transfer: %s", filePath))
 
 	// Проверка существования файла перед его открытием
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("file does not exist: %s", filePath)
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("file does not exist: %w", err)
+	}
+
+	// Файл уже был доставлен, но не перемещен в архив - повторно не отправляем
+	if entry, ok := fileJournal.lookup(filePath); ok && entry.State == stateAcked && err == nil && entry.sameFile(info) {
+		log.Info().Msg(fmt.Sprintf("The file %s has already been delivered, moving to archive", filePath))
+		moveToArchive(r, filePath)
+		return nil
 	}
 
 	file, err := os.Open(filePath)
@@ -421,93 +390,159 @@ func sendFile(filePath string) error {
 		_ = file.Close()
 	}(file)
 
-	// Создаем новый запрос
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
+	inFlight := journalEntry{Path: filePath, State: stateInFlight}
+	if info != nil {
+		inFlight.Size = info.Size()
+		inFlight.ModTime = info.ModTime()
+	}
+	fileJournal.record(inFlight)
 
-	part, err := writer.CreateFormFile("file", filepath.Base(file.Name()))
+	// Имя файла на сервере, в рекурсивном режиме - вместе с относительным путем
+	checksum, encryptedChecksum, err := uploadFile(r, file, filePath, r.relativePath(filePath))
 	if err != nil {
-		log.Error().Msg(fmt.Sprintf("error creating the file form: %v", err))
-		return fmt.Errorf("error creating the file form: %v", err)
+		return err
 	}
 
-	if _, err = io.Copy(part, file); err != nil {
-		log.Error().Msg(fmt.Sprintf("error copying the file to the form: %v", err))
-		return fmt.Errorf("error copying the file to the form: %v", err)
-	}
+	// Фиксируем доставку до перемещения в архив, чтобы не отправить файл повторно
+	fileJournal.record(journalEntry{Path: filePath, State: stateAcked, SHA256: checksum, EncryptedSHA256: encryptedChecksum})
 
-	err = writer.Close()
+	// Обновление статистики
+	fileInfo, err := os.Stat(filePath)
+	if err == nil {
+		r.recordSent(filepath.Base(filePath), fileInfo.Size())
+	} else {
+		log.Error().Msg(fmt.Sprintf("error getting file info: %v", err))
+	}
+	// Закрытие файла перед перемещением
+	err = file.Close()
 	if err != nil {
-		log.Error().Msg(fmt.Sprintf("Error closing the writer: %v", err))
-		return fmt.Errorf("error closing the writer: %v", err)
+		log.Error().Msg(fmt.Sprintf("error closing file: %s", err))
+		return fmt.Errorf("error closing file")
 	}
 
-	// Создаем HTTP-клиент с настроенным TLS
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				// InsecureSkipVerify: true,
-				// Здесь можно добавить корневые сертификаты, если они нужны
-				// RootCAs: rootCAs,
-			},
-		},
+	// Перемещение файла в архив после успешной отправки
+	moveToArchive(r, filePath) // Убедитесь, что moveToArchive не возвращает ошибку
+
+	return nil
+}
+
+// uploadFile отправляет открытый файл на сервер под именем name. При включенном
+// шифровании отправляется зашифрованная копия, большие файлы передаются частями.
+// Возвращает SHA-256 исходного файла и, при шифровании, SHA-256 переданной
+// зашифрованной копии, подтвержденную сервером
+func uploadFile(r *route, file *os.File, filePath, name string) (string, string, error) {
+	size := int64(-1)
+	if stat, err := file.Stat(); err == nil {
+		size = stat.Size()
+	}
+
+	upload := file
+	var plainChecksum string
+	if len(r.config().recipients) > 0 {
+		var err error
+		upload, plainChecksum, err = r.encryptedCopy(file, filePath)
+		if err != nil {
+			log.Error().Msg(err.Error())
+			return "", "", err
+		}
+		// Закрывается до перемещения в архив, где копия удаляется
+		defer upload.Close()
+		name += encryptedExt
+		if stat, err := upload.Stat(); err == nil {
+			size = stat.Size()
+		}
 	}
 
-	req, err := http.NewRequest(http.MethodPost, serverAddr, &buf)
+	// Большие файлы передаются частями с возможностью докачки. Пустой файл не дает
+	// ни одной части, поэтому всегда отправляется одним запросом
+	started := time.Now()
+	var checksum string
+	var err error
+	if cfg := r.config(); cfg.chunkSize > 0 && size > 0 && size >= cfg.chunkThreshold {
+		checksum, err = sendFileChunked(r, upload, filePath, name, size)
+	} else {
+		checksum, err = sendFileMultipart(r, upload, r.config().serverAddr, name, size)
+	}
 	if err != nil {
-		log.Error().Msg(fmt.Sprintf("Error creating the request: %v", err))
-		return fmt.Errorf("error creating the request: %v", err)
+		return "", "", err
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
+	metricUploadDuration.WithLabelValues(r.name).Observe(time.Since(started).Seconds())
+	if plainChecksum != "" {
+		return plainChecksum, checksum, nil
+	}
+	return checksum, "", nil
+}
 
-	// Добавляем заголовок авторизации
-	req.SetBasicAuth(username, password)
+// sendFileMultipart отправляет файл целиком одним multipart-запросом
+func sendFileMultipart(r *route, file *os.File, url, name string, size int64) (string, error) {
+	// Тело запроса формируется потоково, поэтому память обработчика не зависит от размера файла
+	// В рекурсивном режиме сервер получает относительный путь, чтобы воссоздать структуру каталогов
+	var fields []formField
+	if r.config().recursive {
+		fields = append(fields, formField{name: "path", value: filepath.ToSlash(name)})
+	}
+
+	// Запрос может быть сформирован повторно после нового входа на сервер,
+	// поэтому файл каждый раз читается с начала, а контрольная сумма считается заново
+	var digest hash.Hash
+	encoding := r.config().contentEncoding(name)
+	newRequest := func() (*http.Request, error) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		digest = sha256.New()
+		body, contentType, contentLength, err := newMultipartBody(fields, "file", filepath.Base(name), file, size, digest)
+		if err != nil {
+			return nil, err
+		}
+		if encoding != "" {
+			body, contentLength = compressBody(body, encoding), -1
+		}
+		req, err := http.NewRequest(http.MethodPost, url, body)
+		if err != nil {
+			_ = body.Close()
+			return nil, err
+		}
+		req.ContentLength = contentLength
+		req.Header.Set("Content-Type", contentType)
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		return req, nil
+	}
 
-	resp, err := client.Do(req)
+	resp, err := r.do(newRequest)
 	if err != nil {
 		log.Error().Msg(fmt.Sprintf("error sending the request: %v", err))
-		return fmt.Errorf("error sending the request: %v", err)
+		return "", err
 	}
 	defer resp.Body.Close()
 
+	body, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(resp.Body)
 		log.Error().Msg(fmt.Sprintf("error receiving response from server: %s - %s", resp.Status, body))
-		return fmt.Errorf("error receiving response from server: %s - %s", resp.Status, body)
+		return "", newResponseError(resp.StatusCode, body)
 	}
 
-	log.Info().Msg(fmt.Sprintf("Successful connection: %s/ -%s- %s", serverAddr, http.MethodPost, resp.Status)) // Логирование успешного соединения
-
-	// Обновление статистики
-	fileInfo, err := os.Stat(filePath)
-	if err == nil {
-		totalFilesSent++
-		totalBytesSent += fileInfo.Size()
-		lastFileSentName = filepath.Base(filePath)
-		lastFileSentTime = time.Now()
-
-		totalBytesSentMB := float64(totalBytesSent) / (1024 * 1024)
-		fmt.Printf("File successfully sent: %s | Number of files sent: %d | Total size: %.2f MB | Last file: %s at %s\n",
-			lastFileSentName, totalFilesSent, totalBytesSentMB, lastFileSentName, lastFileSentTime.Format(time.RFC3339))
-	} else {
-		log.Error().Msg(fmt.Sprintf("error getting file info: %v", err))
+	// Сервер возвращает контрольную сумму сохраненного файла
+	checksum := hex.EncodeToString(digest.Sum(nil))
+	var reply struct {
+		SHA256 string `json:"sha256"`
 	}
-	// Закрытие файла перед перемещением
-	err = file.Close()
-	if err != nil {
-		log.Error().Msg(fmt.Sprintf("error closing file: %s", err))
-		return fmt.Errorf("error closing file")
+	_ = json.Unmarshal(body, &reply)
+	if err := checkEchoedChecksum(checksum, reply.SHA256); err != nil {
+		return "", err
 	}
 
-	// Перемещение файла в архив после успешной отправки
-	moveToArchive(filePath) // Убедитесь, что moveToArchive не возвращает ошибку
-
-	return nil
+	log.Info().Msg(fmt.Sprintf("Successful connection: %s/ -%s- %s", url, http.MethodPost, resp.Status)) // Логирование успешного соединения
+	return checksum, nil
 }
 
-func moveToArchive(filePath string) {
+func moveToArchive(r *route, filePath string) {
 	currentDate := time.Now().Format("2006-01-02")
-	destDir := filepath.Join(archiveDir, currentDate)
+	// Вложенные каталоги повторяются внутри папки с датой
+	dayDir := filepath.Join(r.config().archiveDir, currentDate)
+	destDir := filepath.Join(dayDir, filepath.Dir(r.relativePath(filePath)))
 
 	// Проверка и создание директории
 	if _, err := os.Stat(destDir); os.IsNotExist(err) {
@@ -517,7 +552,30 @@ func moveToArchive(filePath string) {
 		}
 	}
 
-	destPath := filepath.Join(destDir, filepath.Base(filePath))
+	destPath := uniqueDestPath(destDir, filepath.Base(filePath))
+	r.removeStaged(filePath)
+
+	err := os.Rename(filePath, destPath)
+	if err != nil {
+		log.Error().Msg(fmt.Sprintf("error moving file to archive: %s", err))
+		return
+	}
+
+	log.Info().Msg(fmt.Sprintf("File moved to archive: %s", destPath))
+	r.config().readiness.removeMarkers(filePath)
+
+	record := archiveRecord{Time: time.Now(), Route: r.name, File: filepath.ToSlash(r.relativePath(filePath)), ArchivedTo: destPath}
+	if entry, ok := fileJournal.lookup(filePath); ok {
+		record.Size, record.SHA256, record.EncryptedSHA256 = entry.Size, entry.SHA256, entry.EncryptedSHA256
+	}
+	writeArchiveManifest(dayDir, record)
+	fileJournal.record(journalEntry{Path: filePath, State: stateArchived, ArchivedTo: destPath})
+
+}
+
+// uniqueDestPath возвращает свободное имя файла в каталоге destDir
+func uniqueDestPath(destDir, name string) string {
+	destPath := filepath.Join(destDir, name)
 
 	// Обработка конфликтов имен файлов
 	counter := 1
@@ -531,12 +589,5 @@ func moveToArchive(filePath string) {
 		counter++
 	}
 
-	err := os.Rename(filePath, destPath)
-	if err != nil {
-		log.Error().Msg(fmt.Sprintf("error moving file to archive: %s", err))
-		return
-	}
-
-	log.Info().Msg(fmt.Sprintf("File moved to archive: %s", destPath))
-
+	return destPath
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// После отмены запросов обработчикам дается немного времени, чтобы записать результат
+const cancelWait = 5 * time.Second
+
+var (
+	// stopping отменяется в начале завершения работы: новые файлы больше не передаются обработчикам
+	stopping, stopDispatch = context.WithCancel(context.Background())
+
+	// uploadCtx отменяется, если отправки не завершились за ShutdownGrace
+	uploadCtx, cancelUploads = context.WithCancel(context.Background())
+)
+
+// dispatch ставит файл в очередь обработчиков. После начала завершения работы
+// файл остается в каталоге отправки, а закрепление снимается
+func (r *route) dispatch(filePath string, info os.FileInfo) {
+	if !r.queue.push(filePath, info.Size(), info.ModTime()) {
+		r.releaseFile(filePath)
+	}
+}
+
+// closeQueue закрывает очередь: файлы, которые еще не начали отправляться,
+// остаются в каталоге и будут отправлены после запуска
+func (r *route) closeQueue() {
+	r.releaseQueued(true)
+}
+
+// releaseQueued снимает закрепление с файлов в очереди и в следующем пакете,
+// например при паузе или закрытии окна отправки
+func (r *route) releaseQueued(close bool) {
+	for _, filePath := range append(r.queue.drain(close), r.bundle.takeAll()...) {
+		r.releaseFile(filePath)
+	}
+}
+
+// waitWorkers ждет завершения обработчиков всех направлений не дольше timeout
+func waitWorkers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		for _, r := range routes {
+			r.workerWG.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdown останавливает прием файлов, дожидается текущих отправок в течение grace,
+// затем прерывает оставшиеся, записывает итоговую статистику и закрывает журнал и лог
+func shutdown(grace time.Duration, logWriter io.Closer) {
+	log.Info().Msg(fmt.Sprintf("Terminating the file transfer program, waiting up to %s for uploads in progress...", grace))
+
+	stopDispatch()
+	for _, r := range routes {
+		r.closeQueue()
+	}
+
+	if !waitWorkers(grace) {
+		log.Error().Msg("Uploads did not finish within the grace period, cancelling them")
+		cancelUploads()
+		if !waitWorkers(cancelWait) {
+			log.Error().Msg("Some workers did not stop after cancellation")
+		}
+	}
+
+	for _, r := range routes {
+		r.logStats()
+	}
+	fileJournal.close()
+	log.Info().Msg("The file transfer program has stopped")
+	_ = logWriter.Close()
+}
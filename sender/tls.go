@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// tlsSettings - параметры TLS соединения с сервером
+type tlsSettings struct {
+	certFile   string // клиентский сертификат для взаимной аутентификации (mTLS)
+	keyFile    string
+	caFile     string   // корневые сертификаты частной PKI, если пусто - системные
+	pins       []string // SHA-256 от SubjectPublicKeyInfo сертификата сервера в base64
+	minVersion string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig загружает сертификаты и проверяет настройки при запуске,
+// чтобы ошибки конфигурации не проявлялись только при первой отправке
+func newTLSConfig(s tlsSettings) (*tls.Config, error) {
+	minVersion, ok := tlsVersions[s.minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported MinTLSVersion %q (expected 1.0, 1.1, 1.2 or 1.3)", s.minVersion)
+	}
+	config := &tls.Config{MinVersion: minVersion}
+
+	if s.certFile != "" || s.keyFile != "" {
+		if s.certFile == "" || s.keyFile == "" {
+			return nil, errors.New("both CertFile and KeyFile must be set for client certificate authentication")
+		}
+		for _, file := range []string{s.certFile, s.keyFile} {
+			if _, err := os.Stat(file); err != nil {
+				return nil, fmt.Errorf("error reading client certificate: %v", err)
+			}
+		}
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate %s and key %s: %v", s.certFile, s.keyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if s.caFile != "" {
+		data, err := os.ReadFile(s.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CAFile: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no PEM certificates found in CAFile %s", s.caFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(s.pins) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range s.pins {
+			pin = strings.TrimPrefix(pin, "sha256/")
+			if raw, err := base64.StdEncoding.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+				return nil, fmt.Errorf("invalid server pin %q: expected base64 SHA-256 of the public key", pin)
+			}
+			pins[pin] = true
+		}
+		// Проверка выполняется после обычной проверки цепочки сертификатов
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if pins[spkiPin(cert)] {
+					return nil
+				}
+			}
+			return errors.New("server certificate does not match any configured pin")
+		}
+	}
+
+	return config, nil
+}
+
+// spkiPin вычисляет отпечаток открытого ключа сертификата
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// newHTTPClient создает HTTP-клиент направления с настроенным TLS. Клиент общий
+// для всех обработчиков, чтобы соединения с сервером переиспользовались
+func newHTTPClient(config *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime/multipart"
+	"strings"
+)
+
+// checksumField - поле формы с SHA-256 файла, передается после содержимого файла
+const checksumField = "sha256"
+
+// countingWriter считает количество записанных байт
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// formField - дополнительное текстовое поле multipart-формы
+type formField struct {
+	name  string
+	value string
+}
+
+func writeFields(writer *multipart.Writer, fields []formField) error {
+	for _, field := range fields {
+		if err := writer.WriteField(field.name, field.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// multipartOverhead вычисляет размер служебной части multipart-тела (заголовки,
+// текстовые поля и разделители) для заданной границы, чтобы заранее знать Content-Length
+func multipartOverhead(boundary string, fields []formField, fieldName, fileName string, digest hash.Hash) (int64, error) {
+	counter := &countingWriter{}
+	writer := multipart.NewWriter(counter)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return 0, err
+	}
+	if err := writeFields(writer, fields); err != nil {
+		return 0, err
+	}
+	if _, err := writer.CreateFormFile(fieldName, fileName); err != nil {
+		return 0, err
+	}
+	// Длина контрольной суммы известна заранее
+	if digest != nil {
+		if err := writer.WriteField(checksumField, strings.Repeat("0", hex.EncodedLen(digest.Size()))); err != nil {
+			return 0, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+// newMultipartBody формирует тело multipart-запроса на лету через io.Pipe, не
+// загружая файл в память. Текстовые поля передаются перед файлом. Если задан digest,
+// содержимое хешируется при передаче, а контрольная сумма добавляется полем после
+// файла. Если размер содержимого известен (size >= 0), возвращается точная длина тела, иначе -1
+func newMultipartBody(fields []formField, fieldName, fileName string, content io.Reader, size int64, digest hash.Hash) (io.ReadCloser, string, int64, error) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	contentLength := int64(-1)
+	if size >= 0 {
+		overhead, err := multipartOverhead(writer.Boundary(), fields, fieldName, fileName, digest)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		contentLength = overhead + size
+	}
+
+	go func() {
+		err := writeFields(writer, fields)
+		var part io.Writer
+		if err == nil {
+			part, err = writer.CreateFormFile(fieldName, fileName)
+		}
+		if err == nil {
+			if digest != nil {
+				content = io.TeeReader(content, digest)
+			}
+			err = copyContent(part, content, size)
+		}
+		if err == nil && digest != nil {
+			err = writer.WriteField(checksumField, hex.EncodeToString(digest.Sum(nil)))
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		// Ошибка чтения файла прерывает запрос на стороне HTTP-клиента
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr, writer.FormDataContentType(), contentLength, nil
+}
+
+// copyContent передает содержимое файла. При известном размере передается ровно
+// size байт, чтобы тело запроса совпало с объявленным Content-Length. Если файл
+// изменился после проверки размера, запрос прерывается и отправка повторяется,
+// иначе сервер получил бы обрезанную копию
+func copyContent(dst io.Writer, src io.Reader, size int64) error {
+	if size < 0 {
+		_, err := io.Copy(dst, src)
+		return err
+	}
+	_, err := io.CopyN(dst, src, size)
+	if err == io.EOF {
+		return fmt.Errorf("file shrank during upload: expected %d bytes: %w", size, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := io.ReadFull(src, make([]byte, 1)); n > 0 {
+		return fmt.Errorf("file grew during upload: expected %d bytes", size)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// BenchmarkMultipartBody передает файлы разного размера через newMultipartBody.
+// Число выделений и B/op не зависят от размера файла: тело формируется потоком
+func BenchmarkMultipartBody(b *testing.B) {
+	for _, size := range []int64{1 << 20, 64 << 20, 256 << 20} {
+		b.Run(fmt.Sprintf("%dMB", size>>20), func(b *testing.B) {
+			// Разреженный файл: место на диске не занимается, но читается целиком
+			path := filepath.Join(b.TempDir(), "data.bin")
+			file, err := os.Create(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := file.Truncate(size); err != nil {
+				b.Fatal(err)
+			}
+			defer file.Close()
+
+			fields := []formField{{name: "path", value: "data.bin"}}
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := file.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				body, _, length, err := newMultipartBody(fields, "file", "data.bin", file, size, sha256.New())
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, body)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != length {
+					b.Fatalf("body length %d, Content-Length %d", n, length)
+				}
+			}
+		})
+	}
+}
+
+func TestMultipartBodyChangedFile(t *testing.T) {
+	content := []byte("0123456789")
+
+	// Размер не изменился: передается ровно Content-Length байт
+	body, _, length, err := newMultipartBody(nil, "file", "f.txt", bytes.NewReader(content), int64(len(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, body)
+	if err != nil || n != length {
+		t.Fatalf("unchanged file: read %d bytes (err %v), Content-Length %d", n, err, length)
+	}
+
+	// Файл вырос после проверки размера: запрос прерывается, чтобы сервер не получил обрезанную копию
+	body, _, _, err = newMultipartBody(nil, "file", "f.txt", bytes.NewReader(content), 5, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, body); err == nil || !strings.Contains(err.Error(), "grew") {
+		t.Fatalf("grown file: expected an error, got %v", err)
+	} else if !isRetryable(err) {
+		t.Errorf("grown file: the error must be retryable: %v", err)
+	}
+
+	// Файл уменьшился: запрос прерывается ошибкой
+	body, _, _, err = newMultipartBody(nil, "file", "f.txt", bytes.NewReader(content), 20, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, body); err == nil {
+		t.Fatal("shrunk file: expected an error")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// watchFilesNotify следит за каталогом отправки по событиям файловой системы.
+// Возвращает ошибку, если события недоступны, - тогда используется опрос каталога,
+// и nil при завершении работы программы
+func watchFilesNotify(r *route) error {
+	cfg := r.config()
+	if cfg.watchMode == "auto" && isNetworkMount(cfg.sendDir) {
+		return fmt.Errorf("%s is on a network file system", cfg.sendDir)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := addWatches(r, watcher, cfg.sendDir); err != nil {
+		return err
+	}
+	log.Info().Msg(fmt.Sprintf("Watching folder %s for file system events", cfg.sendDir))
+
+	// Первичная проверка файлов, появившихся до запуска
+	scanDir(r)
+
+	// Файлы, которые еще не готовы к отправке, проверяем с интервалом опроса,
+	// а полный обход каталога выполняем редко на случай пропущенных событий
+	pollInterval, rescanInterval := cfg.pollInterval, cfg.rescanInterval
+	recheck := time.NewTicker(pollInterval)
+	defer recheck.Stop()
+	rescan := time.NewTicker(rescanInterval)
+	defer rescan.Stop()
+
+	for {
+		select {
+		case <-stopping.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("file system watcher closed")
+			}
+			// Новый вложенный каталог: подписываемся на него и проверяем файлы,
+			// которые могли появиться в нем до подписки
+			if cfg.recursive && event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := addWatches(r, watcher, event.Name); err != nil {
+						log.Error().Msg(fmt.Sprintf("error watching directory %s: %v", event.Name, err))
+					}
+					scanDir(r)
+					continue
+				}
+			}
+			handleEvent(r, event.Name)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("file system watcher closed")
+			}
+			// При переполнении очереди событий часть изменений могла быть потеряна
+			log.Error().Msg(fmt.Sprintf("file system watcher error: %v", err))
+			scanDir(r)
+		case <-recheck.C:
+			for _, filePath := range r.pendingFiles() {
+				checkPath(r, filePath)
+			}
+		case <-rescan.C:
+			scanDir(r)
+		}
+
+		// Интервалы могли измениться при перечитывании настроек
+		if current := r.config(); current.pollInterval != pollInterval || current.rescanInterval != rescanInterval {
+			pollInterval, rescanInterval = current.pollInterval, current.rescanInterval
+			recheck.Reset(pollInterval)
+			rescan.Reset(rescanInterval)
+		}
+	}
+}
+
+// addWatches подписывается на события каталога, а в рекурсивном режиме - и всех
+// вложенных каталогов, кроме служебных
+func addWatches(r *route, watcher *fsnotify.Watcher, dir string) error {
+	if !r.config().recursive {
+		return watcher.Add(dir)
+	}
+	return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if path != r.config().sendDir && r.isServiceDir(path) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// handleEvent сразу проверяет только новые файлы. Готовность уже известных файлов
+// проверяется по таймеру, чтобы не реагировать на каждую запись в файл
+func handleEvent(r *route, filePath string) {
+	r.mu.Lock()
+	_, exists := r.firstSeen[filePath]
+	r.mu.Unlock()
+
+	if exists {
+		if _, err := os.Stat(filePath); err == nil {
+			return
+		}
+	}
+	checkPath(r, filePath)
+}
+
+// checkPath проверяет один файл каталога отправки (или вложенного каталога в рекурсивном режиме)
+func checkPath(r *route, filePath string) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		r.mu.Lock()
+		if _, exists := r.firstSeen[filePath]; exists {
+			r.forgetFileLocked(filePath)
+		}
+		delete(r.ignored, filePath)
+		r.mu.Unlock()
+		return
+	}
+	if info.IsDir() || !r.watches(filePath) {
+		return
+	}
+
+	checkFile(r, filePath, info)
+}
+
+// pendingFiles возвращает отслеживаемые файлы, которые еще не переданы обработчикам
+func (r *route) pendingFiles() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files := make([]string, 0, len(r.firstSeen))
+	for filePath := range r.firstSeen {
+		if !r.inFlight[filePath] {
+			files = append(files, filePath)
+		}
+	}
+	return files
+}
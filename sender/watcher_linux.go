@@ -0,0 +1,24 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Сигнатуры сетевых файловых систем, на которых inotify не видит чужих изменений
+var networkFsTypes = map[uint32]bool{
+	0x6969:     true, // NFS
+	0x517B:     true, // SMB
+	0xFF534D42: true, // CIFS
+	0xFE534D42: true, // SMB2
+	0x65735546: true, // FUSE (sshfs и т.п.)
+	0x01021997: true, // 9P
+}
+
+// isNetworkMount проверяет, расположен ли каталог на сетевой файловой системе
+func isNetworkMount(dir string) bool {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return false
+	}
+	return networkFsTypes[uint32(stat.Type)]
+}
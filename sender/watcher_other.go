@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// isNetworkMount распознает только UNC-пути вида \\server\share
+func isNetworkMount(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(filepath.VolumeName(abs), `\\`)
+}